@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+var exportFormats = map[string]datastore.Format{
+	"jsonl":  datastore.FormatJSONLines,
+	"binary": datastore.FormatBinary,
+}
+
+var exportContentTypes = map[datastore.Format]string{
+	datastore.FormatJSONLines: "application/x-ndjson",
+	datastore.FormatBinary:    "application/octet-stream",
+}
+
+// exportHandler streams the whole key space, the format is chosen with
+// the "format" query parameter (jsonl by default).
+func exportHandler(db *datastore.Db, auth *authenticator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(w, r, auth) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		name := r.URL.Query().Get("format")
+		if name == "" {
+			name = "jsonl"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "unknown format "+name)
+			return
+		}
+		w.Header().Set("Content-Type", exportContentTypes[format])
+		w.WriteHeader(http.StatusOK)
+		if err := db.Export(w, format); err != nil {
+			// the status is already sent, the client sees a truncated stream
+			log.Printf("Export failed: %s", err)
+		}
+	}
+}
+
+type ImportResult struct {
+	Imported int    `json:"imported"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// importHandler reads records in any of the export formats. Failures get
+// the statuses of the /db/ API, the records before the failed one are
+// imported anyway.
+func importHandler(db *datastore.Db, auth *authenticator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(w, r, auth) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		defer r.Body.Close()
+		var res ImportResult
+		status := http.StatusOK
+		n, err := db.Import(r.Body)
+		res.Imported = n
+		if err != nil {
+			status, res.Code = dbErrorStatus(err)
+			res.Error = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// authorizeAdmin lets in the clients with the admin operation granted on
+// the whole key space.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, auth *authenticator) bool {
+	cred, ok := auth.authenticateHTTP(w, r)
+	if !ok {
+		return false
+	}
+	if !cred.allowsAll(opAdmin) {
+		forbidden(w, cred, opAdmin)
+		return false
+	}
+	return true
+}
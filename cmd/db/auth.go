@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Clients authenticate with API keys sent as "Authorization: Bearer <key>"
+// over HTTP, as the "authorization" metadata over gRPC and with AUTH over
+// the Redis protocol. The auth file lists the SHA-256 sums of the keys
+// along with their grants:
+//
+//	{"keys": [{
+//		"name": "server",
+//		"sha256": "<hex sum of the key>",
+//		"grants": [{"bucket": "", "prefix": "user:", "ops": ["read", "write"]}]
+//	}]}
+//
+// A grant covers the keys of the bucket which start with the prefix, the
+// "*" bucket covers all the buckets. Admin endpoints export and import the
+// whole key space, so they need the admin operation granted on all of it.
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opAdmin = "admin"
+
+	anyBucket = "*"
+)
+
+type grant struct {
+	Bucket string   `json:"bucket"`
+	Prefix string   `json:"prefix"`
+	Ops    []string `json:"ops"`
+}
+
+type authKey struct {
+	Name   string  `json:"name"`
+	Sha256 string  `json:"sha256"`
+	Grants []grant `json:"grants"`
+}
+
+type authConfig struct {
+	Keys []authKey `json:"keys"`
+}
+
+// credential is the identity of an authenticated client, nil credentials
+// allow nothing.
+type credential struct {
+	name   string
+	grants []grant
+}
+
+// allows tells whether the operation is granted on all the keys of the
+// bucket which start with the prefix. A single key is checked as a prefix
+// of itself.
+func (c *credential) allows(op, bucket, prefix string) bool {
+	if c == nil {
+		return false
+	}
+	for _, g := range c.grants {
+		if (g.Bucket == bucket || g.Bucket == anyBucket) &&
+			strings.HasPrefix(prefix, g.Prefix) && hasOp(g.Ops, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAll tells whether the operation is granted on the whole key space.
+func (c *credential) allowsAll(op string) bool {
+	return c.allows(op, anyBucket, "")
+}
+
+func hasOp(ops []string, op string) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// fullAccess is the credential of every client when authentication is
+// disabled.
+var fullAccess = &credential{
+	name:   "anonymous",
+	grants: []grant{{Bucket: anyBucket, Ops: []string{opRead, opWrite, opAdmin}}},
+}
+
+// authenticator maps the API keys to the credentials, the nil one lets
+// everyone in with full access.
+type authenticator struct {
+	keys map[[sha256.Size]byte]*credential
+}
+
+func loadAuth(path string) (*authenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg authConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("malformed auth file: %s", err)
+	}
+	return newAuthenticator(cfg)
+}
+
+func newAuthenticator(cfg authConfig) (*authenticator, error) {
+	a := &authenticator{keys: make(map[[sha256.Size]byte]*credential)}
+	for _, k := range cfg.Keys {
+		var sum [sha256.Size]byte
+		if n, err := hex.Decode(sum[:], []byte(k.Sha256)); err != nil || n != len(sum) {
+			return nil, fmt.Errorf("key %q: sha256 must be %d hex bytes", k.Name, len(sum))
+		}
+		if _, ok := a.keys[sum]; ok {
+			return nil, fmt.Errorf("key %q is listed twice", k.Name)
+		}
+		for _, g := range k.Grants {
+			for _, op := range g.Ops {
+				if op != opRead && op != opWrite && op != opAdmin {
+					return nil, fmt.Errorf("key %q: unknown operation %q", k.Name, op)
+				}
+			}
+		}
+		a.keys[sum] = &credential{name: k.Name, grants: k.Grants}
+	}
+	return a, nil
+}
+
+// authenticate returns the credential of the API key, it is nil when the
+// key is unknown.
+func (a *authenticator) authenticate(key string) *credential {
+	if a == nil {
+		return fullAccess
+	}
+	if key == "" {
+		return nil
+	}
+	// only the sums are compared, so the lookup leaks nothing useful
+	// about the keys through timing
+	return a.keys[sha256.Sum256([]byte(key))]
+}
+
+// authenticateHTTP checks the API key of the request, the 401 response is
+// sent when it fails.
+func (a *authenticator) authenticateHTTP(w http.ResponseWriter, r *http.Request) (*credential, bool) {
+	cred := a.authenticate(bearerToken(r.Header.Get("Authorization")))
+	if cred == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing or unknown API key")
+		return nil, false
+	}
+	return cred, true
+}
+
+// bearerToken extracts the key of the Bearer authorization scheme, it is
+// empty for other schemes.
+func bearerToken(header string) string {
+	const scheme = "bearer "
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(scheme):])
+}
+
+func forbidden(w http.ResponseWriter, cred *credential, op string) {
+	writeError(w, http.StatusForbidden, codeForbidden,
+		fmt.Sprintf("%s access is not granted to %q", op, cred.name))
+}
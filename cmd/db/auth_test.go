@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/SofiaMazur/razur_s2_lab3/dbpb"
+)
+
+func keySum(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestAuth grants the "reader" key reading the "user:" keys of the
+// default bucket, the "writer" key reading and writing the "users" bucket
+// and the "admin" key everything.
+func newTestAuth(t *testing.T) *authenticator {
+	auth, err := newAuthenticator(authConfig{Keys: []authKey{
+		{Name: "reader", Sha256: keySum("reader-key"), Grants: []grant{
+			{Prefix: "user:", Ops: []string{opRead}},
+		}},
+		{Name: "writer", Sha256: keySum("writer-key"), Grants: []grant{
+			{Bucket: "users", Ops: []string{opRead, opWrite}},
+		}},
+		{Name: "admin", Sha256: keySum("admin-key"), Grants: []grant{
+			{Bucket: anyBucket, Ops: []string{opRead, opWrite, opAdmin}},
+		}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestNewAuthenticator_Invalid(t *testing.T) {
+	for _, cfg := range []authConfig{
+		{Keys: []authKey{{Name: "short", Sha256: "abcd"}}},
+		{Keys: []authKey{{Name: "op", Sha256: keySum("k"), Grants: []grant{{Ops: []string{"delete"}}}}}},
+		{Keys: []authKey{{Name: "a", Sha256: keySum("k")}, {Name: "b", Sha256: keySum("k")}}},
+	} {
+		if _, err := newAuthenticator(cfg); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestCredential_Allows(t *testing.T) {
+	auth := newTestAuth(t)
+	reader, writer := auth.authenticate("reader-key"), auth.authenticate("writer-key")
+	if auth.authenticate("unknown") != nil || auth.authenticate("") != nil {
+		t.Fatal("Unknown keys must not be authenticated")
+	}
+	for _, tc := range []struct {
+		cred               *credential
+		op, bucket, prefix string
+		expected           bool
+	}{
+		{reader, opRead, "", "user:1", true},
+		{reader, opRead, "", "user:", true},
+		{reader, opRead, "", "user", false},
+		{reader, opRead, "users", "user:1", false},
+		{reader, opWrite, "", "user:1", false},
+		{writer, opWrite, "users", "any", true},
+		{writer, opWrite, "", "any", false},
+		{writer, opAdmin, "users", "any", false},
+		{nil, opRead, "", "user:1", false},
+	} {
+		if got := tc.cred.allows(tc.op, tc.bucket, tc.prefix); got != tc.expected {
+			t.Errorf("%+v: expected %t", tc, tc.expected)
+		}
+	}
+	if writer.allowsAll(opRead) || !auth.authenticate("admin-key").allowsAll(opAdmin) {
+		t.Error("Unexpected whole key space access")
+	}
+	if !(*authenticator)(nil).authenticate("").allowsAll(opAdmin) {
+		t.Error("Disabled authentication must allow everything")
+	}
+}
+
+func authRequest(t *testing.T, method, url, key, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestDbHandler_Auth(t *testing.T) {
+	server, _ := newTestServer(t, newTestAuth(t))
+
+	resp := authRequest(t, "GET", server.URL+"/db/user:1", "", "")
+	checkError(t, resp, http.StatusUnauthorized, codeUnauthorized)
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Error("WWW-Authenticate is not set")
+	}
+	checkError(t, authRequest(t, "GET", server.URL+"/db/user:1", "wrong", ""), http.StatusUnauthorized, codeUnauthorized)
+
+	checkError(t, authRequest(t, "PUT", server.URL+"/db/user:1", "reader-key", `{"value":"v"}`), http.StatusForbidden, codeForbidden)
+	if resp := authRequest(t, "PUT", server.URL+"/db/user:1", "admin-key", `{"value":"v"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected admin PUT status %d", resp.StatusCode)
+	}
+	if resp := authRequest(t, "GET", server.URL+"/db/user:1", "reader-key", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected reader GET status %d", resp.StatusCode)
+	}
+	checkError(t, authRequest(t, "GET", server.URL+"/db/users/user:1", "reader-key", ""), http.StatusForbidden, codeForbidden)
+	if resp := authRequest(t, "DELETE", server.URL+"/db/users/1", "writer-key", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected writer DELETE status %d", resp.StatusCode)
+	}
+
+	mget := server.URL + "/db/_mget"
+	checkError(t, authRequest(t, "POST", mget, "reader-key", `{"keys":["user:1","other"]}`), http.StatusForbidden, codeForbidden)
+	if resp := authRequest(t, "POST", mget, "reader-key", `{"keys":["user:1","user:2"]}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected reader mget status %d", resp.StatusCode)
+	}
+
+	checkError(t, authRequest(t, "GET", server.URL+"/admin/export", "", ""), http.StatusUnauthorized, codeUnauthorized)
+	checkError(t, authRequest(t, "GET", server.URL+"/admin/export", "writer-key", ""), http.StatusForbidden, codeForbidden)
+	resp = authRequest(t, "GET", server.URL+"/admin/export", "admin-key", "")
+	if data, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(data), "user:1") {
+		t.Errorf("Unexpected export %d %s", resp.StatusCode, data)
+	}
+}
+
+func TestGrpcServer_Auth(t *testing.T) {
+	client := newTestGrpcClient(t, newTestAuth(t))
+	withKey := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key)
+	}
+
+	_, err := client.Get(context.Background(), &dbpb.GetRequest{Key: "user:1"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated, got %v", err)
+	}
+	_, err = client.Put(withKey("reader-key"), &dbpb.PutRequest{Key: "user:1", Value: []byte("v")})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied, got %v", err)
+	}
+	if _, err := client.Put(withKey("writer-key"), &dbpb.PutRequest{Bucket: "users", Key: "1", Value: []byte("v")}); err != nil {
+		t.Error(err)
+	}
+
+	stream, err := client.Scan(withKey("reader-key"), &dbpb.ScanRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for a scan of the bucket, got %v", err)
+	}
+	stream, err = client.Scan(withKey("reader-key"), &dbpb.ScanRequest{Prefix: "user:"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err != io.EOF {
+		t.Errorf("Expected an empty scan, got %v", err)
+	}
+	watch, err := client.Watch(withKey("writer-key"), &dbpb.WatchRequest{AllBuckets: true})
+	if err == nil {
+		_, err = watch.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for watching all buckets, got %v", err)
+	}
+}
+
+func TestRespServer_Auth(t *testing.T) {
+	c := newTestRespClient(t, newTestAuth(t))
+
+	c.command("GET", "user:1")
+	c.expect("-NOAUTH Authentication required.\r\n")
+	c.command("AUTH", "wrong")
+	c.expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	c.command("AUTH", "default", "reader-key")
+	c.expect("+OK\r\n")
+	c.command("GET", "user:1")
+	c.expect("$-1\r\n")
+	c.command("MGET", "user:1", "other")
+	c.expect("-NOPERM this user has no permissions to access one of the keys used as arguments\r\n")
+	c.command("SET", "user:1", "v")
+	c.expect("-NOPERM this user has no permissions to access one of the keys used as arguments\r\n")
+	c.command("SCAN", "0")
+	c.expect("-NOPERM this user has no permissions to access one of the keys used as arguments\r\n")
+
+	c.command("AUTH", "admin-key")
+	c.expect("+OK\r\n")
+	c.command("SET", "user:1", "v")
+	c.expect("+OK\r\n")
+
+	c = newTestRespClient(t, nil)
+	c.command("AUTH", "key")
+	c.expect("-ERR AUTH <password> called without any password configured for the default user.\r\n")
+}
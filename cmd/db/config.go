@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+const (
+	confAddr           = "DB_ADDR"
+	confGrpcAddr       = "DB_GRPC_ADDR"
+	confRespAddr       = "DB_RESP_ADDR"
+	confDir            = "DB_DIR"
+	confSegmentSizeMb  = "DB_SEGMENT_SIZE_MB"
+	confSync           = "DB_SYNC"
+	confMergeThreshold = "DB_MERGE_THRESHOLD"
+	confReadOnly       = "DB_READ_ONLY"
+	confAuthFile       = "DB_AUTH_FILE"
+	confIndex          = "DB_INDEX"
+)
+
+const maxSegmentSizeMb = 1024
+
+var syncModes = map[string]datastore.SyncMode{
+	"none":   datastore.SyncNone,
+	"always": datastore.SyncAlways,
+}
+
+// indexMode tells how the keys of the sealed segments are indexed.
+type indexMode int
+
+const (
+	// indexMemory keeps every key in memory
+	indexMemory indexMode = iota
+	// indexDisk keeps the segment indices on disk, see
+	// datastore.WithDiskIndex
+	indexDisk
+	// indexSorted sorts the merged segments as well, see
+	// datastore.WithSortedSegments
+	indexSorted
+)
+
+var indexModes = map[string]indexMode{
+	"memory": indexMemory,
+	"disk":   indexDisk,
+	"sorted": indexSorted,
+}
+
+type config struct {
+	addr           string
+	grpcAddr       string
+	respAddr       string
+	dir            string
+	segmentSizeMb  int
+	syncMode       datastore.SyncMode
+	mergeThreshold int
+	readOnly       bool
+	authFile       string
+	index          indexMode
+}
+
+// parseConfig reads the configuration from the command line, the
+// environment variables provide the defaults of the flags.
+func parseConfig(args []string, getenv func(string) string) (config, error) {
+	var (
+		cfg   config
+		sync  string
+		index string
+		err   error
+	)
+	env := func(name, def string) string {
+		if value := getenv(name); value != "" {
+			return value
+		}
+		return def
+	}
+	envInt := func(name string, def int) int {
+		if err != nil || getenv(name) == "" {
+			return def
+		}
+		var n int
+		if n, err = strconv.Atoi(getenv(name)); err != nil {
+			err = fmt.Errorf("%s: %s is not a number", name, getenv(name))
+		}
+		return n
+	}
+	envBool := func(name string) bool {
+		if err != nil || getenv(name) == "" {
+			return false
+		}
+		var b bool
+		if b, err = strconv.ParseBool(getenv(name)); err != nil {
+			err = fmt.Errorf("%s: %s is not a boolean", name, getenv(name))
+		}
+		return b
+	}
+
+	fs := flag.NewFlagSet("db", flag.ContinueOnError)
+	fs.StringVar(&cfg.addr, "addr", env(confAddr, ":8091"), "listen address in the host:port form")
+	// the extra protocols are only served when asked for
+	fs.StringVar(&cfg.grpcAddr, "grpc-addr", env(confGrpcAddr, ""), "gRPC listen address such as :8092, empty disables gRPC")
+	fs.StringVar(&cfg.respAddr, "resp-addr", env(confRespAddr, ""), "Redis protocol listen address such as :6379, empty disables it")
+	fs.StringVar(&cfg.dir, "dir", env(confDir, "./out/storage/"), "data directory")
+	fs.IntVar(&cfg.segmentSizeMb, "segment-size-mb", envInt(confSegmentSizeMb, datastore.MaxFileSizeMb), "size of a segment in megabytes")
+	fs.StringVar(&sync, "sync", env(confSync, "none"), "when to flush writes to disk: none or always")
+	fs.StringVar(&index, "index", env(confIndex, "memory"), "index of the sealed segments: memory, disk or sorted; the last two hold more keys than fit in memory")
+	fs.IntVar(&cfg.mergeThreshold, "merge-threshold", envInt(confMergeThreshold, datastore.DefaultMergeThreshold), "number of sealed segments which starts a merge, 0 disables merges")
+	fs.BoolVar(&cfg.readOnly, "read-only", envBool(confReadOnly), "serve the data directory without changing it")
+	fs.StringVar(&cfg.authFile, "auth-file", env(confAuthFile, ""), "file with the API keys and their grants, empty disables authentication")
+	if err != nil {
+		return cfg, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.addr); err != nil {
+		return cfg, fmt.Errorf("bad listen address: %s", err)
+	}
+	if cfg.grpcAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.grpcAddr); err != nil {
+			return cfg, fmt.Errorf("bad gRPC listen address: %s", err)
+		}
+	}
+	if cfg.respAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.respAddr); err != nil {
+			return cfg, fmt.Errorf("bad Redis protocol listen address: %s", err)
+		}
+	}
+	if cfg.dir == "" {
+		return cfg, fmt.Errorf("data directory is not set")
+	}
+	if cfg.segmentSizeMb <= 0 || cfg.segmentSizeMb > maxSegmentSizeMb {
+		return cfg, fmt.Errorf("segment size must be in range 1..%d MB", maxSegmentSizeMb)
+	}
+	mode, ok := syncModes[sync]
+	if !ok {
+		return cfg, fmt.Errorf("unknown sync mode %q", sync)
+	}
+	cfg.syncMode = mode
+	if cfg.index, ok = indexModes[index]; !ok {
+		return cfg, fmt.Errorf("unknown index mode %q", index)
+	}
+	if cfg.mergeThreshold < 0 || cfg.mergeThreshold == 1 {
+		return cfg, fmt.Errorf("merge threshold must be zero or at least 2")
+	}
+	return cfg, nil
+}
+
+func (cfg config) options() []datastore.Option {
+	opts := []datastore.Option{
+		datastore.WithSyncMode(cfg.syncMode),
+		datastore.WithMergeThreshold(cfg.mergeThreshold),
+	}
+	switch cfg.index {
+	case indexDisk:
+		opts = append(opts, datastore.WithDiskIndex())
+	case indexSorted:
+		opts = append(opts, datastore.WithSortedSegments())
+	}
+	return opts
+}
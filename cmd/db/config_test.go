@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+func TestParseConfig(t *testing.T) {
+	env := map[string]string{
+		confAddr:          "127.0.0.1:9000",
+		confGrpcAddr:      ":8092",
+		confSegmentSizeMb: "4",
+		confSync:          "always",
+		confIndex:         "sorted",
+	}
+	cfg, err := parseConfig([]string{"-segment-size-mb", "2", "-dir", "/tmp/db"}, func(name string) string {
+		return env[name]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := config{
+		addr:           "127.0.0.1:9000",
+		grpcAddr:       ":8092",
+		dir:            "/tmp/db",
+		segmentSizeMb:  2,
+		syncMode:       datastore.SyncAlways,
+		mergeThreshold: datastore.DefaultMergeThreshold,
+		index:          indexSorted,
+	}
+	if cfg != expected {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	for _, args := range [][]string{
+		{"-addr", "8091"},
+		{"-grpc-addr", "8092"},
+		{"-resp-addr", "6379"},
+		{"-dir", ""},
+		{"-segment-size-mb", "0"},
+		{"-sync", "sometimes"},
+		{"-index", "btree"},
+		{"-merge-threshold", "1"},
+	} {
+		if _, err := parseConfig(args, noEnv); err == nil {
+			t.Errorf("%v is accepted", args)
+		}
+	}
+	badEnv := func(name string) string {
+		if name == confMergeThreshold {
+			return "many"
+		}
+		return ""
+	}
+	if _, err := parseConfig(nil, badEnv); err == nil {
+		t.Error("Bad environment variable is accepted")
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/razur_s2_lab3/datastore"
-	"github.com/razur_s2_lab3/signal"
+	"google.golang.org/grpc"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+	"github.com/SofiaMazur/razur_s2_lab3/httptools"
+	"github.com/SofiaMazur/razur_s2_lab3/metrics"
+	"github.com/SofiaMazur/razur_s2_lab3/signal"
 )
 
 type InData struct {
@@ -20,75 +31,338 @@ type OutData struct {
 	Value string	`json:"value"`
 }
 
-const port string = "8091"
-const path string = "./out/storage/"
+// values of at least this size are stored compressed
+const compressThreshold = 1024
+
+// active requests are given this long to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+const (
+	maxKeySize   = 1024
+	maxValueSize = 1 << 20
+	// JSON escaping makes a value up to six times longer
+	maxBodySize = 6*maxValueSize + 1024
+)
+
+// splitPath extracts the bucket and the key from /db/{bucket}/{key}.
+// Paths with a single element address the default bucket. The path is
+// split before unescaping, so keys may contain escaped slashes.
+func splitPath(u *url.URL) (bucket, key string, err error) {
+	path := u.EscapedPath()
+	if !strings.HasPrefix(path, "/db/") {
+		path = u.Path
+	}
+	rest := path[len("/db/"):]
+	if i := strings.Index(rest, "/"); i >= 0 {
+		if bucket, err = url.PathUnescape(rest[:i]); err != nil {
+			return "", "", err
+		}
+		rest = rest[i+1:]
+	}
+	key, err = url.PathUnescape(rest)
+	return bucket, key, err
+}
+
+const dbMethods = "GET, HEAD, PUT, POST, DELETE"
 
-func dbHandler(db *datastore.Db) func (http.ResponseWriter, *http.Request) {
-	return func (w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Path[len("/db/"):]
-		var c InData
-		if r.Method == "POST" {
-			defer r.Body.Close()
-			body, err := ioutil.ReadAll(r.Body)
+// dbRoutes serves the /db/ paths and passes the others to next. The
+// routes are matched by the escaped path: ServeMux would redirect keys
+// like a%2F%2Fb or x%2F..%2Fy to their cleaned paths and send a key
+// escaped as %5Fmget to the _mget endpoint.
+func dbRoutes(db *datastore.Db, auth *authenticator, next http.Handler) http.Handler {
+	keys := dbHandler(db, auth)
+	mget := mgetHandler(db, auth)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		switch {
+		case path == "/db/_mget":
+			mget(w, r)
+		case strings.HasPrefix(path, "/db/"):
+			keys(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func dbHandler(db *datastore.Db, auth *authenticator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := auth.authenticateHTTP(w, r)
+		if !ok {
+			return
+		}
+		bucketName, key, err := splitPath(r.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "bad path: "+err.Error())
+			return
+		}
+		if key == "" {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "key is not set")
+			return
+		}
+		bucket := db.Bucket(bucketName)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if !cred.allows(opRead, bucketName, key) {
+				forbidden(w, cred, opRead)
+				return
+			}
+			value, err := bucket.GetContext(r.Context(), key)
+			if err != nil {
+				writeDbError(w, err)
+				return
+			}
+			res, err := json.Marshal(&InData{Value: value})
 			if err != nil {
-				http.Error(w, "{}", http.StatusInternalServerError)
+				writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
 				return
 			}
-			if err = json.Unmarshal(body, &c); err != nil {
-				http.Error(w, "{}", http.StatusInternalServerError)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodGet {
+				w.Write(res)
+			}
+		case http.MethodPut, http.MethodPost:
+			if !cred.allows(opWrite, bucketName, key) {
+				forbidden(w, cred, opWrite)
 				return
 			}
-			if err = db.Put(key, c.Value); err != nil {
-				http.Error(w, "{}", http.StatusInternalServerError)
-			} else {
-				w.WriteHeader(http.StatusOK)
+			var c InData
+			if !readJSON(w, r, &c) {
+				return
 			}
-			return
+			if err := bucket.PutContext(r.Context(), key, c.Value); err != nil {
+				writeDbError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			if !cred.allows(opWrite, bucketName, key) {
+				forbidden(w, cred, opWrite)
+				return
+			}
+			if err := bucket.DeleteContext(r.Context(), key); err != nil {
+				writeDbError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, dbMethods)
 		}
+	}
+}
 
-		if r.Method == "GET" {
-			value, err := db.Get(key)
-			if err != nil {
-				if err == datastore.ErrNotFound || err == datastore.ErrHashSums {
-					http.Error(w, "{}", http.StatusNotFound)
-				} else {
-					http.Error(w, "{}", http.StatusInternalServerError)
-				}
+// the longest list of keys accepted by /db/_mget
+const maxMGetKeys = 1000
+
+type MGetRequest struct {
+	Bucket string   `json:"bucket,omitempty"`
+	Keys   []string `json:"keys"`
+}
+
+type MGetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// mgetHandler reads many keys of a bucket in one request. The path takes
+// precedence over /db/, so the "_mget" key of the default bucket is
+// reachable only with this handler.
+func mgetHandler(db *datastore.Db, auth *authenticator) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := auth.authenticateHTTP(w, r)
+		if !ok {
+			return
+		}
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		var req MGetRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if len(req.Keys) > maxMGetKeys {
+			writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge,
+				fmt.Sprintf("at most %d keys are allowed", maxMGetKeys))
+			return
+		}
+		for _, key := range req.Keys {
+			if !cred.allows(opRead, req.Bucket, key) {
+				forbidden(w, cred, opRead)
 				return
 			}
-			c.Value = value
-			if res, err := json.Marshal(&c); err != nil {
-				http.Error(w, "{}", http.StatusInternalServerError)
-			} else {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
-				w.Write(res)
+		}
+		values, err := db.Bucket(req.Bucket).GetManyContext(r.Context(), req.Keys)
+		if err != nil {
+			writeDbError(w, err)
+			return
+		}
+		res := MGetResponse{Values: values, Missing: []string{}}
+		for _, key := range req.Keys {
+			if _, ok := values[key]; !ok {
+				res.Missing = append(res.Missing, key)
 			}
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(&res)
+	}
+}
+
+// readJSON decodes the request body into v, the error response is sent
+// when it fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		if len(body) >= maxBodySize {
+			writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, "request body is too large")
+		} else {
+			writeError(w, http.StatusBadRequest, codeBadRequest, err.Error())
+		}
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "malformed JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+const (
+	confEncryptionKeys    = "DB_ENCRYPTION_KEYS"
+	confEncryptionKeyFile = "DB_ENCRYPTION_KEY_FILE"
+)
+
+// encryptionOptions reads the encryption keys from the key file or the
+// environment, the data is stored in plain text when neither is set.
+func encryptionOptions() ([]datastore.Option, error) {
+	keys := os.Getenv(confEncryptionKeys)
+	if keyFile := os.Getenv(confEncryptionKeyFile); keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = string(data)
+	}
+	if keys == "" {
+		return nil, nil
+	}
+	keyring, err := datastore.ParseKeyring(keys)
+	if err != nil {
+		return nil, err
 	}
+	log.Printf("Encryption enabled, current key id %d", keyring.Current)
+	return []datastore.Option{datastore.WithEncryption(keyring)}, nil
 }
 
 func main() {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		e := os.MkdirAll(path, os.ModePerm)
+	cfg, err := parseConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Printf("Bad configuration: %s", err)
+		os.Exit(2)
+	}
+	if _, err := os.Stat(cfg.dir); os.IsNotExist(err) && !cfg.readOnly {
+		e := os.MkdirAll(cfg.dir, os.ModePerm)
 		if e != nil {
 			panic(e)
 		}
 	}
-	sizeBytes := datastore.MaxFileSizeMb * 1024 * 1024
-	db, err := datastore.NewDb(path, int64(sizeBytes))
+	opts, err := encryptionOptions()
 	if err != nil {
 		panic(err)
+	}
+	registry := metrics.NewRegistry()
+	opts = append(opts, cfg.options()...)
+	opts = append(opts,
+		datastore.WithCompression(compressThreshold),
+		datastore.WithMaxKeySize(maxKeySize),
+		datastore.WithMaxValueSize(maxValueSize),
+		datastore.WithMetrics(newDbMetrics(registry)))
+	sizeBytes := int64(cfg.segmentSizeMb) * 1024 * 1024
+	var db *datastore.Db
+	if cfg.readOnly {
+		log.Printf("Serving %s read-only", cfg.dir)
+		db, err = datastore.OpenReadOnly(cfg.dir, opts...)
 	} else {
-		defer db.Close()
+		db, err = datastore.NewDb(cfg.dir, sizeBytes, opts...)
 	}
-
-	
-	http.HandleFunc("/db/", dbHandler(db))
-	log.Printf("Starting server on " + port + " port...")
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	if err != nil {
+		panic(err)
+	}
+	var auth *authenticator
+	if cfg.authFile != "" {
+		if auth, err = loadAuth(cfg.authFile); err != nil {
+			log.Fatalf("Cannot load the API keys: %s", err)
+		}
+		log.Printf("Authentication enabled, %d API keys", len(auth.keys))
 	} else {
-		signal.WaitForTerminationSignal()
+		log.Printf("Authentication is disabled, every client has full access")
+	}
+
+	h := new(http.ServeMux)
+	// dumps of any size take longer than the server timeouts
+	h.Handle("/admin/export", httptools.Streaming(http.HandlerFunc(exportHandler(db, auth))))
+	h.Handle("/admin/import", httptools.Streaming(http.HandlerFunc(importHandler(db, auth))))
+	h.Handle("/metrics", registry)
+	server := httptools.CreateServerAddr(cfg.addr, dbRoutes(db, auth, h))
+	log.Printf("Starting server on %s...", cfg.addr)
+	server.Start()
+
+	var gs *grpc.Server
+	if cfg.grpcAddr != "" {
+		lis, err := net.Listen("tcp", cfg.grpcAddr)
+		if err != nil {
+			log.Fatalf("Cannot listen for gRPC: %s", err)
+		}
+		gs = newGrpcServer(db, auth)
+		log.Printf("Starting gRPC server on %s...", cfg.grpcAddr)
+		go func() {
+			if err := gs.Serve(lis); err != nil {
+				log.Fatalf("gRPC server finished: %s", err)
+			}
+		}()
+	}
+	var rs *respServer
+	if cfg.respAddr != "" {
+		lis, err := net.Listen("tcp", cfg.respAddr)
+		if err != nil {
+			log.Fatalf("Cannot listen for the Redis protocol: %s", err)
+		}
+		rs = newRespServer(db, auth)
+		log.Printf("Starting Redis protocol server on %s...", cfg.respAddr)
+		go func() {
+			if err := rs.Serve(lis); err != nil {
+				log.Fatalf("Redis protocol server finished: %s", err)
+			}
+		}()
+	}
+	signal.WaitForTerminationSignal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown failed: %s", err)
+	}
+	if gs != nil {
+		// watch streams never end by themselves
+		stopped := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			gs.Stop()
+		}
+	}
+	if rs != nil {
+		rs.Close()
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Database close failed: %s", err)
 	}
 }
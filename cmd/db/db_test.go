@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+func newTestServer(t *testing.T, auth *authenticator) (*httptest.Server, string) {
+	dir, err := os.MkdirTemp("", "test-db-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	h := new(http.ServeMux)
+	h.HandleFunc("/admin/export", exportHandler(db, auth))
+	h.HandleFunc("/admin/import", importHandler(db, auth))
+	server := httptest.NewServer(dbRoutes(db, auth, h))
+	t.Cleanup(server.Close)
+	return server, dir
+}
+
+func request(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// checkError verifies the status and the error code of the response.
+func checkError(t *testing.T, resp *http.Response, status int, code string) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Errorf("Expected status %d, got %d", status, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected error content type %q", ct)
+	}
+	var res ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != code || res.Message == "" {
+		t.Errorf("Unexpected error body %+v", res)
+	}
+}
+
+func TestDbHandler(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	url := server.URL + "/db/bucket/key"
+
+	if resp := request(t, "PUT", url, `{"value":"v1"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected PUT status %d", resp.StatusCode)
+	}
+	resp := request(t, "GET", url, "")
+	var data InData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil || data.Value != "v1" {
+		t.Errorf("Unexpected GET result %+v, %v", data, err)
+	}
+	if resp := request(t, "HEAD", url, ""); resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		t.Errorf("Unexpected HEAD response %d, length %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	checkError(t, request(t, "POST", url, `{"value":`), http.StatusBadRequest, codeBadRequest)
+	checkError(t, request(t, "GET", server.URL+"/db/", ""), http.StatusBadRequest, codeBadRequest)
+
+	resp = request(t, "PATCH", url, "")
+	checkError(t, resp, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	if allow := resp.Header.Get("Allow"); allow != dbMethods {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+
+	if resp := request(t, "DELETE", url, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Unexpected DELETE status %d", resp.StatusCode)
+	}
+	checkError(t, request(t, "GET", url, ""), http.StatusNotFound, codeNotFound)
+}
+
+func TestDbHandler_Checksum(t *testing.T) {
+	server, dir := newTestServer(t, nil)
+	if resp := request(t, "POST", server.URL+"/db/k", `{"value":"value"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected POST status %d", resp.StatusCode)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "current-data"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the value of the first record starts after the size, the key and
+	// the value length
+	if _, err := f.WriteAt([]byte("V"), int64(4+4+len("k")+4)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	checkError(t, request(t, "GET", server.URL+"/db/k", ""), http.StatusInternalServerError, codeChecksumMismatch)
+}
+
+func TestMGetHandler(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	for _, key := range []string{"a", "b"} {
+		request(t, "PUT", server.URL+"/db/bucket/"+key, `{"value":"value-`+key+`"}`)
+	}
+	resp := request(t, "POST", server.URL+"/db/_mget", `{"bucket":"bucket","keys":["a","b","c"]}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+	var res MGetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	expected := MGetResponse{
+		Values:  map[string]string{"a": "value-a", "b": "value-b"},
+		Missing: []string{"c"},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Unexpected response %+v", res)
+	}
+
+	checkError(t, request(t, "GET", server.URL+"/db/_mget", ""), http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	checkError(t, request(t, "POST", server.URL+"/db/_mget", `{"keys":"a"}`), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestDbHandler_EscapedKey(t *testing.T) {
+	server, _ := newTestServer(t, nil)
+	request(t, "PUT", server.URL+"/db/bucket/a%2Fb", `{"value":"v1"}`)
+	request(t, "PUT", server.URL+"/db/a/b", `{"value":"v2"}`)
+
+	resp := request(t, "GET", server.URL+"/db/bucket/a%2Fb", "")
+	var data InData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil || data.Value != "v1" {
+		t.Errorf("Unexpected escaped key value %+v, %v", data, err)
+	}
+	checkError(t, request(t, "GET", server.URL+"/db/bucket/a", ""), http.StatusNotFound, codeNotFound)
+
+	// paths ServeMux would clean and a key named as an endpoint
+	for _, path := range []string{"a%2F%2Fb", "x%2F..%2Fy", "%2E%2E", "%5Fmget"} {
+		url := server.URL + "/db/" + path
+		if resp := request(t, "PUT", url, `{"value":"`+path+`"}`); resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected PUT status of %s: %d", path, resp.StatusCode)
+			continue
+		}
+		resp := request(t, "GET", url, "")
+		var data InData
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil || data.Value != path {
+			t.Errorf("Unexpected value of %s: %+v, %v", path, data, err)
+		}
+	}
+}
+
+func TestImportHandler_Errors(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-import-handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(db *datastore.Db, body string) (*httptest.ResponseRecorder, ImportResult) {
+		rec := httptest.NewRecorder()
+		importHandler(db, nil)(rec, httptest.NewRequest("POST", "/admin/import", strings.NewReader(body)))
+		var res ImportResult
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return rec, res
+	}
+
+	rec, res := post(db, `{"key":"a","value":"1"}`+"\n"+`{"key":`)
+	if rec.Code != http.StatusBadRequest || res.Code != codeBadRequest || res.Imported != 1 {
+		t.Errorf("Unexpected malformed import result %d %+v", rec.Code, res)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rec, res = post(db, `{"key":"b","value":"2"}`)
+	if rec.Code != http.StatusServiceUnavailable || res.Code != codeUnavailable {
+		t.Errorf("Unexpected closed import result %d %+v", rec.Code, res)
+	}
+
+	db, err = datastore.NewDb(dir, 1<<20, datastore.WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rec, res = post(db, `{"key":"b","value":"2"}`)
+	if rec.Code != http.StatusForbidden || res.Code != codeReadOnly || res.Imported != 0 {
+		t.Errorf("Unexpected read-only import result %d %+v", rec.Code, res)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+// error codes of the API, clients should rely on them rather than on the
+// messages
+const (
+	codeBadRequest       = "bad_request"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeTooLarge         = "too_large"
+	codeReadOnly         = "read_only"
+	codeChecksumMismatch = "checksum_mismatch"
+	codeCorrupted        = "corrupted"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal"
+)
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{Code: code, Message: message})
+}
+
+// writeDbError reports the datastore error with a matching status.
+func writeDbError(w http.ResponseWriter, err error) {
+	status, code := dbErrorStatus(err)
+	writeError(w, status, code, err.Error())
+}
+
+// dbErrorStatus returns the status and the error code of the datastore
+// error, the errors may be wrapped.
+func dbErrorStatus(err error) (int, string) {
+	is := func(targets ...error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case is(datastore.ErrNotFound):
+		return http.StatusNotFound, codeNotFound
+	case is(datastore.ErrInvalidBucket, datastore.ErrMalformedImport):
+		return http.StatusBadRequest, codeBadRequest
+	case is(datastore.ErrKeyTooLarge, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	case is(datastore.ErrReadOnly):
+		return http.StatusForbidden, codeReadOnly
+	case is(datastore.ErrHashSums):
+		// the stored data is damaged, it must not look like a missing key
+		return http.StatusInternalServerError, codeChecksumMismatch
+	case is(datastore.ErrCorrupted):
+		return http.StatusInternalServerError, codeCorrupted
+	case is(datastore.ErrClosed, context.Canceled, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, codeUnavailable
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// methodNotAllowed rejects the request listing the allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method is not allowed, use "+allow)
+}
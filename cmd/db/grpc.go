@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+	"github.com/SofiaMazur/razur_s2_lab3/dbpb"
+)
+
+// pending events of a Watch call, slower clients are disconnected
+const watchBuffer = 256
+
+type grpcServer struct {
+	dbpb.UnimplementedDbServer
+	db *datastore.Db
+}
+
+func newGrpcServer(db *datastore.Db, auth *authenticator) *grpc.Server {
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := authenticateGrpc(ctx, auth)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authenticateGrpc(ss.Context(), auth)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &authStream{ss, ctx})
+		}))
+	dbpb.RegisterDbServer(s, &grpcServer{db: db})
+	return s
+}
+
+type credentialKey struct{}
+
+// authenticateGrpc checks the API key sent as the "authorization" metadata
+// in the HTTP form and stores the credential in the context.
+func authenticateGrpc(ctx context.Context, auth *authenticator) (context.Context, error) {
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		key = bearerToken(md.Get("authorization")[0])
+	}
+	cred := auth.authenticate(key)
+	if cred == nil {
+		return nil, status.Error(codes.Unauthenticated, "missing or unknown API key")
+	}
+	return context.WithValue(ctx, credentialKey{}, cred), nil
+}
+
+// authorize checks that the operation is granted on the keys of the bucket
+// starting with the prefix.
+func authorize(ctx context.Context, op, bucket, prefix string) error {
+	cred, _ := ctx.Value(credentialKey{}).(*credential)
+	if !cred.allows(op, bucket, prefix) {
+		return status.Errorf(codes.PermissionDenied, "%s access is not granted", op)
+	}
+	return nil
+}
+
+// authStream carries the context with the credential to stream handlers.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcError converts the datastore error to a gRPC status. The errors may
+// be wrapped, they are matched as in dbErrorStatus.
+func grpcError(err error) error {
+	is := func(targets ...error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+	code := codes.Internal
+	switch {
+	case is(context.Canceled, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case is(datastore.ErrNotFound):
+		code = codes.NotFound
+	case is(datastore.ErrInvalidBucket, datastore.ErrKeyTooLarge, datastore.ErrValueTooLarge):
+		code = codes.InvalidArgument
+	case is(datastore.ErrReadOnly):
+		code = codes.FailedPrecondition
+	case is(datastore.ErrHashSums, datastore.ErrCorrupted):
+		code = codes.DataLoss
+	case is(datastore.ErrUnknownKey):
+		// the server lacks the key of the record, like HTTP it is an
+		// internal error
+		code = codes.Internal
+	case is(datastore.ErrClosed):
+		code = codes.Unavailable
+	case is(datastore.ErrWatchOverflow):
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, err.Error())
+}
+
+// checkKey rejects the empty keys as the HTTP API does.
+func checkKey(key string) error {
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "key is not set")
+	}
+	return nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *dbpb.GetRequest) (*dbpb.GetResponse, error) {
+	if err := checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, opRead, req.Bucket, req.Key); err != nil {
+		return nil, err
+	}
+	value, err := s.db.Bucket(req.Bucket).GetContext(ctx, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &dbpb.GetResponse{Value: []byte(value)}, nil
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *dbpb.PutRequest) (*dbpb.PutResponse, error) {
+	if err := checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, opWrite, req.Bucket, req.Key); err != nil {
+		return nil, err
+	}
+	if err := s.db.Bucket(req.Bucket).PutContext(ctx, req.Key, string(req.Value)); err != nil {
+		return nil, grpcError(err)
+	}
+	return &dbpb.PutResponse{}, nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *dbpb.DeleteRequest) (*dbpb.DeleteResponse, error) {
+	if err := checkKey(req.Key); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, opWrite, req.Bucket, req.Key); err != nil {
+		return nil, err
+	}
+	if err := s.db.Bucket(req.Bucket).DeleteContext(ctx, req.Key); err != nil {
+		return nil, grpcError(err)
+	}
+	return &dbpb.DeleteResponse{}, nil
+}
+
+func (s *grpcServer) MGet(ctx context.Context, req *dbpb.MGetRequest) (*dbpb.MGetResponse, error) {
+	if len(req.Keys) > maxMGetKeys {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d keys are allowed", maxMGetKeys)
+	}
+	for _, key := range req.Keys {
+		if err := authorize(ctx, opRead, req.Bucket, key); err != nil {
+			return nil, err
+		}
+	}
+	values, err := s.db.Bucket(req.Bucket).GetManyContext(ctx, req.Keys)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &dbpb.MGetResponse{Values: make(map[string][]byte, len(values))}
+	for _, key := range req.Keys {
+		if value, ok := values[key]; ok {
+			res.Values[key] = []byte(value)
+		} else {
+			res.Missing = append(res.Missing, key)
+		}
+	}
+	return res, nil
+}
+
+func (s *grpcServer) Scan(req *dbpb.ScanRequest, stream dbpb.Db_ScanServer) error {
+	if err := authorize(stream.Context(), opRead, req.Bucket, req.Prefix); err != nil {
+		return err
+	}
+	err := s.db.Bucket(req.Bucket).Scan(req.Prefix, func(key, value string) error {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		return stream.Send(&dbpb.Record{Bucket: req.Bucket, Key: key, Value: []byte(value)})
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return grpcError(err)
+	}
+	return nil
+}
+
+var eventTypes = map[datastore.EventType]dbpb.Event_Type{
+	datastore.EventPut:        dbpb.Event_PUT,
+	datastore.EventDelete:     dbpb.Event_DELETE,
+	datastore.EventDropBucket: dbpb.Event_DROP_BUCKET,
+}
+
+func (s *grpcServer) Watch(req *dbpb.WatchRequest, stream dbpb.Db_WatchServer) error {
+	bucket := req.Bucket
+	if req.AllBuckets {
+		bucket = anyBucket
+	}
+	if err := authorize(stream.Context(), opRead, bucket, req.Prefix); err != nil {
+		return err
+	}
+	w, err := s.db.Watch(watchBuffer)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer w.Close()
+	// the headers tell the client that the writes are watched from now on
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-w.Events():
+			if !ok {
+				if err := w.Err(); err != nil {
+					return grpcError(err)
+				}
+				return nil
+			}
+			if !req.AllBuckets && e.Bucket != req.Bucket {
+				continue
+			}
+			// bucket drops concern all the keys
+			if e.Type != datastore.EventDropBucket && !strings.HasPrefix(e.Key, req.Prefix) {
+				continue
+			}
+			err := stream.Send(&dbpb.Event{
+				Type:   eventTypes[e.Type],
+				Bucket: e.Bucket,
+				Key:    e.Key,
+				Value:  []byte(e.Value),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+	"github.com/SofiaMazur/razur_s2_lab3/dbpb"
+)
+
+func newTestGrpcClient(t *testing.T, auth *authenticator) dbpb.DbClient {
+	dir, err := os.MkdirTemp("", "test-db-grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	lis := bufconn.Listen(1 << 20)
+	s := newGrpcServer(db, auth)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	conn, err := grpc.Dial("bufnet", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return dbpb.NewDbClient(conn)
+}
+
+func TestGrpcServer(t *testing.T) {
+	client := newTestGrpcClient(t, nil)
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := client.Put(ctx, &dbpb.PutRequest{Bucket: "bucket", Key: key, Value: []byte("value-" + key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := client.Get(ctx, &dbpb.GetRequest{Bucket: "bucket", Key: "a"})
+	if err != nil || string(res.Value) != "value-a" {
+		t.Errorf("Unexpected Get result %v, %v", res, err)
+	}
+	if _, err := client.Delete(ctx, &dbpb.DeleteRequest{Bucket: "bucket", Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, &dbpb.GetRequest{Bucket: "bucket", Key: "b"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+
+	mget, err := client.MGet(ctx, &dbpb.MGetRequest{Bucket: "bucket", Keys: []string{"a", "b", "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(mget.Values["a"]) != "value-a" || string(mget.Values["c"]) != "value-c" ||
+		len(mget.Values) != 2 || !reflect.DeepEqual(mget.Missing, []string{"b"}) {
+		t.Errorf("Unexpected MGet result %v", mget)
+	}
+
+	stream, err := client.Scan(ctx, &dbpb.ScanRequest{Bucket: "bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for {
+		rec, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, rec.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("Unexpected scanned keys %v", keys)
+	}
+}
+
+func TestGrpcServer_Errors(t *testing.T) {
+	client := newTestGrpcClient(t, nil)
+	ctx := context.Background()
+
+	if _, err := client.Get(ctx, &dbpb.GetRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an empty Get key, got %v", err)
+	}
+	if _, err := client.Put(ctx, &dbpb.PutRequest{Value: []byte("v")}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an empty Put key, got %v", err)
+	}
+	if _, err := client.Delete(ctx, &dbpb.DeleteRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an empty Delete key, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{fmt.Errorf("%w: 7", datastore.ErrUnknownKey), codes.Internal},
+		{fmt.Errorf("record 3: %w", datastore.ErrKeyTooLarge), codes.InvalidArgument},
+		{fmt.Errorf("read: %w", datastore.ErrNotFound), codes.NotFound},
+		{fmt.Errorf("put: %w", datastore.ErrClosed), codes.Unavailable},
+		{fmt.Errorf("put: %w", context.Canceled), codes.Canceled},
+	} {
+		if code := status.Code(grpcError(tc.err)); code != tc.code {
+			t.Errorf("Error %v is converted to %s, expected %s", tc.err, code, tc.code)
+		}
+	}
+}
+
+func TestGrpcServer_Watch(t *testing.T) {
+	client := newTestGrpcClient(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &dbpb.WatchRequest{Bucket: "bucket", Prefix: "user/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	writes := []*dbpb.PutRequest{
+		{Bucket: "bucket", Key: "user/1", Value: []byte("one")},
+		{Bucket: "bucket", Key: "other", Value: []byte("skipped")},
+		{Bucket: "other", Key: "user/1", Value: []byte("skipped")},
+		{Bucket: "bucket", Key: "user/2", Value: []byte("two")},
+	}
+	for _, req := range writes {
+		if _, err := client.Put(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Delete(ctx, &dbpb.DeleteRequest{Bucket: "bucket", Key: "user/1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"PUT user/1 one", "PUT user/2 two", "DELETE user/1 "}
+	for _, e := range expected {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ev.Type.String() + " " + ev.Key + " " + string(ev.Value); got != e {
+			t.Errorf("Expected event %q, got %q", e, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+	"github.com/SofiaMazur/razur_s2_lab3/metrics"
+)
+
+// dbMetrics exposes the datastore measurements in the Prometheus format.
+type dbMetrics struct {
+	puts, gets, merges      *metrics.Counter
+	putLatency, getLatency  *metrics.Histogram
+	mergeDuration           *metrics.Histogram
+	writtenRecords, written *metrics.Counter
+	segments, diskBytes     *metrics.Gauge
+}
+
+func newDbMetrics(r *metrics.Registry) *dbMetrics {
+	return &dbMetrics{
+		puts:           r.NewCounter("db_puts_total", "Single record writes by result.", "result"),
+		putLatency:     r.NewHistogram("db_put_duration_seconds", "Latency of single record writes.", metrics.DefaultBuckets),
+		gets:           r.NewCounter("db_gets_total", "Reads by result: hit, miss, hash_mismatch or error.", "result"),
+		getLatency:     r.NewHistogram("db_get_duration_seconds", "Latency of reads.", metrics.DefaultBuckets),
+		writtenRecords: r.NewCounter("db_written_records_total", "Records written by the write loop."),
+		written:        r.NewCounter("db_written_bytes_total", "Bytes written by the write loop."),
+		merges:         r.NewCounter("db_merges_total", "Merges of sealed segments by result.", "result"),
+		mergeDuration:  r.NewHistogram("db_merge_duration_seconds", "Duration of merges.", metrics.DefaultBuckets),
+		segments:       r.NewGauge("db_segments", "Sealed segments."),
+		diskBytes:      r.NewGauge("db_disk_bytes", "Size of the data files."),
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (m *dbMetrics) ObservePut(d time.Duration, err error) {
+	m.puts.Inc(result(err))
+	m.putLatency.Observe(d.Seconds())
+}
+
+func (m *dbMetrics) ObserveGet(d time.Duration, err error) {
+	res := "hit"
+	switch err {
+	case nil:
+	case datastore.ErrNotFound:
+		res = "miss"
+	case datastore.ErrHashSums:
+		res = "hash_mismatch"
+	default:
+		res = "error"
+	}
+	m.gets.Inc(res)
+	m.getLatency.Observe(d.Seconds())
+}
+
+func (m *dbMetrics) ObserveWrite(records int, bytes int64, _ time.Duration) {
+	m.writtenRecords.Add(float64(records))
+	m.written.Add(float64(bytes))
+}
+
+func (m *dbMetrics) ObserveMerge(d time.Duration, err error) {
+	m.merges.Inc(result(err))
+	m.mergeDuration.Observe(d.Seconds())
+}
+
+func (m *dbMetrics) SetStorage(segments int, bytes int64) {
+	m.segments.Set(float64(segments))
+	m.diskBytes.Set(float64(bytes))
+}
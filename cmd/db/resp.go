@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+const (
+	// longest inline command or RESP header line
+	maxRespLine = 64 << 10
+	// most arguments of a single command
+	maxRespArgs = 1 << 16
+	// most bytes of the arguments of a single command
+	maxRespCommand = 16 << 20
+	// keys visited by SCAN without COUNT
+	defaultScanCount = 10
+)
+
+var errRespProtocol = errors.New("Protocol error")
+
+// respServer serves the default bucket over the RESP2 protocol of Redis,
+// so redis-cli and Redis client libraries work with it.
+type respServer struct {
+	db     *datastore.Db
+	bucket *datastore.Bucket
+	auth   *authenticator
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mtx    sync.Mutex
+	lis    net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newRespServer(db *datastore.Db, auth *authenticator) *respServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &respServer{
+		db:     db,
+		bucket: db.Bucket(""),
+		auth:   auth,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections until Close is called.
+func (s *respServer) Serve(lis net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return lis.Close()
+	}
+	s.lis = lis
+	s.mtx.Unlock()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mtx.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting connections, closes the active ones and waits for
+// their commands to finish.
+func (s *respServer) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	s.cancel()
+	var err error
+	if s.lis != nil {
+		err = s.lis.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *respServer) handle(conn net.Conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	r := bufio.NewReaderSize(conn, maxRespLine)
+	w := bufio.NewWriter(conn)
+	// clients start unauthenticated unless authentication is disabled
+	cred := s.auth.authenticate("")
+	for {
+		args, err := readRespCommand(r)
+		if err != nil {
+			if errors.Is(err, errRespProtocol) {
+				writeRespError(w, "ERR "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(w, args, &cred)
+		// replies of pipelined commands are sent together
+		if quit || r.Buffered() == 0 {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readRespCommand reads a command sent either as an array of bulk strings
+// or inline.
+func readRespCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxRespArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRespProtocol)
+	}
+	// Redis skips empty and null arrays
+	if n <= 0 {
+		return nil, nil
+	}
+	args := make([]string, 0, n)
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readRespLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRespProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBodySize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRespProtocol)
+		}
+		if total += size; total > maxRespCommand {
+			return nil, fmt.Errorf("%w: too big request", errRespProtocol)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRespProtocol)
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func readRespLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: too big request", errRespProtocol)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func writeRespSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeRespError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + msg + "\r\n")
+}
+
+func writeRespInt(w *bufio.Writer, n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func writeRespBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func writeRespNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeRespArray(w *bufio.Writer, n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// respCommand runs the command with the arguments following its name.
+type respCommand struct {
+	// minArgs and maxArgs limit the number of arguments, -1 is unlimited
+	minArgs, maxArgs int
+	// ops must be granted on the arguments from firstKey to lastKey, -1
+	// is the last argument. The whole bucket is checked when firstKey is
+	// -1.
+	ops               []string
+	firstKey, lastKey int
+	run               func(s *respServer, w *bufio.Writer, args []string) error
+}
+
+var (
+	readOps      = []string{opRead}
+	writeOps     = []string{opWrite}
+	readWriteOps = []string{opRead, opWrite}
+)
+
+var respCommands = map[string]respCommand{
+	"PING":    {0, 1, nil, 0, 0, (*respServer).ping},
+	"GET":     {1, 1, readOps, 0, 0, (*respServer).get},
+	"SET":     {2, 4, writeOps, 0, 0, (*respServer).set},
+	"DEL":     {1, -1, writeOps, 0, -1, (*respServer).del},
+	"EXISTS":  {1, -1, readOps, 0, -1, (*respServer).exists},
+	"INCR":    {1, 1, readWriteOps, 0, 0, (*respServer).incr},
+	"MGET":    {1, -1, readOps, 0, -1, (*respServer).mget},
+	"SCAN":    {1, 5, readOps, -1, -1, (*respServer).scan},
+	"EXPIRE":  {2, 2, writeOps, 0, 0, (*respServer).expire},
+	"COMMAND": {0, -1, nil, 0, 0, (*respServer).command},
+}
+
+// exec runs the command on behalf of the credential and writes its reply.
+// It tells whether the client asked to close the connection.
+func (s *respServer) exec(w *bufio.Writer, args []string, cred **credential) (quit bool) {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "QUIT":
+		writeRespSimple(w, "OK")
+		return true
+	case "AUTH":
+		s.authenticate(w, args[1:], cred)
+		return false
+	}
+	if *cred == nil {
+		writeRespError(w, "NOAUTH Authentication required.")
+		return false
+	}
+	cmd, ok := respCommands[name]
+	if !ok {
+		writeRespError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	n := len(args) - 1
+	if n < cmd.minArgs || (cmd.maxArgs >= 0 && n > cmd.maxArgs) {
+		writeRespError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	if !cmd.allowed(*cred, args[1:]) {
+		writeRespError(w, "NOPERM this user has no permissions to access one of the keys used as arguments")
+		return false
+	}
+	if err := cmd.run(s, w, args[1:]); err != nil {
+		writeRespError(w, respErrorMessage(err))
+	}
+	return false
+}
+
+func (cmd respCommand) allowed(cred *credential, args []string) bool {
+	for _, op := range cmd.ops {
+		if cmd.firstKey < 0 {
+			if !cred.allows(op, "", "") {
+				return false
+			}
+			continue
+		}
+		last := cmd.lastKey
+		if last < 0 {
+			last = len(args) - 1
+		}
+		for _, key := range args[cmd.firstKey : last+1] {
+			if !cred.allows(op, "", key) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// authenticate handles AUTH, the user name of the two argument form is
+// ignored. A failed attempt keeps the previous credential.
+func (s *respServer) authenticate(w *bufio.Writer, args []string, cred **credential) {
+	if len(args) != 1 && len(args) != 2 {
+		writeRespError(w, "ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	if s.auth == nil {
+		writeRespError(w, "ERR AUTH <password> called without any password configured for the default user.")
+		return
+	}
+	c := s.auth.authenticate(args[len(args)-1])
+	if c == nil {
+		writeRespError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	*cred = c
+	writeRespSimple(w, "OK")
+}
+
+var errRespSyntax = errors.New("syntax error")
+
+func respErrorMessage(err error) string {
+	switch err {
+	case datastore.ErrNotInteger:
+		return "ERR value is not an integer or out of range"
+	case datastore.ErrReadOnly:
+		return "READONLY You can't write against a read only replica."
+	}
+	if err != errRespSyntax {
+		log.Printf("RESP command failed: %s", err)
+	}
+	return "ERR " + err.Error()
+}
+
+func (s *respServer) ping(w *bufio.Writer, args []string) error {
+	if len(args) == 1 {
+		writeRespBulk(w, args[0])
+	} else {
+		writeRespSimple(w, "PONG")
+	}
+	return nil
+}
+
+func (s *respServer) get(w *bufio.Writer, args []string) error {
+	value, err := s.bucket.GetContext(s.ctx, args[0])
+	if err == datastore.ErrNotFound {
+		writeRespNull(w)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	writeRespBulk(w, value)
+	return nil
+}
+
+// set supports the EX and PX options only.
+func (s *respServer) set(w *bufio.Writer, args []string) error {
+	var ttl time.Duration
+	if len(args) > 2 {
+		if len(args) != 4 {
+			return errRespSyntax
+		}
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return datastore.ErrNotInteger
+		}
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			return errRespSyntax
+		}
+		if n <= 0 || ttl <= 0 {
+			return errors.New("invalid expire time in 'set' command")
+		}
+	}
+	var err error
+	if ttl > 0 {
+		err = s.bucket.PutTTLContext(s.ctx, args[0], args[1], ttl)
+	} else {
+		err = s.bucket.PutContext(s.ctx, args[0], args[1])
+	}
+	if err != nil {
+		return err
+	}
+	writeRespSimple(w, "OK")
+	return nil
+}
+
+func (s *respServer) del(w *bufio.Writer, args []string) error {
+	values, err := s.bucket.GetManyContext(s.ctx, args)
+	if err != nil {
+		return err
+	}
+	var n int64
+	for key := range values {
+		if err := s.bucket.DeleteContext(s.ctx, key); err != nil {
+			return err
+		}
+		n++
+	}
+	writeRespInt(w, n)
+	return nil
+}
+
+func (s *respServer) exists(w *bufio.Writer, args []string) error {
+	values, err := s.bucket.GetManyContext(s.ctx, args)
+	if err != nil {
+		return err
+	}
+	// repeated keys are counted every time, as Redis does
+	var n int64
+	for _, key := range args {
+		if _, ok := values[key]; ok {
+			n++
+		}
+	}
+	writeRespInt(w, n)
+	return nil
+}
+
+func (s *respServer) incr(w *bufio.Writer, args []string) error {
+	n, err := s.bucket.IncrContext(s.ctx, args[0], 1)
+	if err != nil {
+		return err
+	}
+	writeRespInt(w, n)
+	return nil
+}
+
+func (s *respServer) mget(w *bufio.Writer, args []string) error {
+	values, err := s.bucket.GetManyContext(s.ctx, args)
+	if err != nil {
+		return err
+	}
+	writeRespArray(w, len(args))
+	for _, key := range args {
+		if value, ok := values[key]; ok {
+			writeRespBulk(w, value)
+		} else {
+			writeRespNull(w)
+		}
+	}
+	return nil
+}
+
+var errScanCursor = errors.New("invalid cursor")
+
+// scan continues after the last key visited by the previous call, so keys
+// written or deleted between the calls don't shift the others. Only the
+// page of keys after the cursor is collected and sorted. The cursor is
+// the key with every byte written as three decimal digits after
+// a leading 1, clients which expect a number still parse it.
+func (s *respServer) scan(w *bufio.Writer, args []string) error {
+	after, started, err := decodeScanCursor(args[0])
+	if err != nil {
+		return err
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errRespSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				return errRespSyntax
+			}
+		default:
+			return errRespSyntax
+		}
+	}
+
+	var keys []string
+	last, more, err := s.bucket.ScanPage(after, started, count, func(key, value string) error {
+		if matchGlob(pattern, key) {
+			keys = append(keys, key)
+		}
+		return s.ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+	next := "0"
+	if more {
+		next = encodeScanCursor(last)
+	}
+	writeRespArray(w, 2)
+	writeRespBulk(w, next)
+	writeRespArray(w, len(keys))
+	for _, key := range keys {
+		writeRespBulk(w, key)
+	}
+	return nil
+}
+
+func encodeScanCursor(key string) string {
+	var b strings.Builder
+	b.Grow(1 + 3*len(key))
+	b.WriteByte('1')
+	for i := 0; i < len(key); i++ {
+		fmt.Fprintf(&b, "%03d", key[i])
+	}
+	return b.String()
+}
+
+// decodeScanCursor returns the key to continue after, started is false
+// for the cursor 0 of the first call.
+func decodeScanCursor(cursor string) (key string, started bool, err error) {
+	if cursor == "0" {
+		return "", false, nil
+	}
+	if len(cursor)%3 != 1 || cursor[0] != '1' {
+		return "", false, errScanCursor
+	}
+	buf := make([]byte, 0, len(cursor)/3)
+	for i := 1; i < len(cursor); i += 3 {
+		c, err := strconv.ParseUint(cursor[i:i+3], 10, 8)
+		if err != nil {
+			return "", false, errScanCursor
+		}
+		buf = append(buf, byte(c))
+	}
+	return string(buf), true, nil
+}
+
+func (s *respServer) expire(w *bufio.Writer, args []string) error {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return datastore.ErrNotInteger
+	}
+	found, err := s.bucket.ExpireContext(s.ctx, args[0], time.Duration(seconds)*time.Second)
+	if err != nil {
+		return err
+	}
+	if found {
+		writeRespInt(w, 1)
+	} else {
+		writeRespInt(w, 0)
+	}
+	return nil
+}
+
+// command answers the introspection done by redis-cli on start with an
+// empty list.
+func (s *respServer) command(w *bufio.Writer, args []string) error {
+	writeRespArray(w, 0)
+	return nil
+}
+
+// matchGlob matches the string against the glob-style pattern of Redis:
+// * and ? wildcards, [...] classes with ranges and ^ negation, and \
+// escapes. A mismatch after a star retries the rest of the pattern one
+// byte further, only the last star is retried, so the time is bounded by
+// len(pattern)*len(s).
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, mark = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if next, ok := matchToken(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		mark++
+		p, i = star, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchToken matches the byte against the pattern token at p and returns
+// the position of the next token.
+func matchToken(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '[':
+		end := strings.IndexByte(pattern[p+1:], ']')
+		if end < 0 {
+			// an unterminated class matches literally
+			return p + 1, c == '['
+		}
+		class := pattern[p+1 : p+1+end]
+		negate := strings.HasPrefix(class, "^")
+		if negate {
+			class = class[1:]
+		}
+		return p + end + 2, matchClass(class, c) != negate
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return p + 1, pattern[p] == c
+}
+
+func matchClass(class string, c byte) bool {
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= c && c <= hi {
+				return true
+			}
+			i += 2
+		} else if class[i] == c {
+			return true
+		}
+	}
+	return false
+}
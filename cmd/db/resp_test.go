@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SofiaMazur/razur_s2_lab3/datastore"
+)
+
+type respClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestRespClient(t *testing.T, auth *authenticator) *respClient {
+	dir, err := os.MkdirTemp("", "test-db-resp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newRespServer(db, auth)
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &respClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// command sends the arguments as an array of bulk strings.
+func (c *respClient) command(args ...string) {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	c.send(b.String())
+}
+
+func (c *respClient) send(raw string) {
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads exactly the expected raw reply.
+func (c *respClient) expect(reply string) {
+	c.t.Helper()
+	buf := make([]byte, len(reply))
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		c.t.Fatalf("Cannot read %q: %s", reply, err)
+	}
+	if string(buf) != reply {
+		c.t.Fatalf("Expected %q, got %q", reply, buf)
+	}
+}
+
+func TestRespServer(t *testing.T) {
+	c := newTestRespClient(t, nil)
+
+	c.command("PING")
+	c.expect("+PONG\r\n")
+	c.command("ping", "hello")
+	c.expect("$5\r\nhello\r\n")
+
+	c.command("GET", "key")
+	c.expect("$-1\r\n")
+	c.command("SET", "key", "value")
+	c.expect("+OK\r\n")
+	c.command("GET", "key")
+	c.expect("$5\r\nvalue\r\n")
+
+	c.command("INCR", "counter")
+	c.expect(":1\r\n")
+	c.command("INCR", "counter")
+	c.expect(":2\r\n")
+	c.command("INCR", "key")
+	c.expect("-ERR value is not an integer or out of range\r\n")
+
+	c.command("EXISTS", "key", "missing", "key")
+	c.expect(":2\r\n")
+	c.command("MGET", "key", "missing", "counter")
+	c.expect("*3\r\n$5\r\nvalue\r\n$-1\r\n$1\r\n2\r\n")
+
+	cursor := encodeScanCursor("counter")
+	c.command("SCAN", "0", "COUNT", "1")
+	c.expect("*2\r\n$" + strconv.Itoa(len(cursor)) + "\r\n" + cursor + "\r\n*1\r\n$7\r\ncounter\r\n")
+	// keys before the cursor don't move it
+	c.command("SET", "a", "value")
+	c.expect("+OK\r\n")
+	c.command("SCAN", cursor, "MATCH", "k*")
+	c.expect("*2\r\n$1\r\n0\r\n*1\r\n$3\r\nkey\r\n")
+	c.command("SCAN", "12")
+	c.expect("-ERR invalid cursor\r\n")
+	c.command("DEL", "a")
+	c.expect(":1\r\n")
+
+	c.command("DEL", "key", "missing")
+	c.expect(":1\r\n")
+	c.command("EXISTS", "key")
+	c.expect(":0\r\n")
+
+	c.command("GET")
+	c.expect("-ERR wrong number of arguments for 'get' command\r\n")
+	c.command("FLUSHALL")
+	c.expect("-ERR unknown command 'FLUSHALL'\r\n")
+	c.command("SET", "key", "value", "NX")
+	c.expect("-ERR syntax error\r\n")
+}
+
+func TestRespServer_Expire(t *testing.T) {
+	c := newTestRespClient(t, nil)
+
+	c.command("SET", "short", "value", "PX", "50")
+	c.expect("+OK\r\n")
+	c.command("SET", "key", "value")
+	c.expect("+OK\r\n")
+	c.command("EXPIRE", "key", "0")
+	c.expect(":1\r\n")
+	c.command("EXPIRE", "missing", "10")
+	c.expect(":0\r\n")
+	c.command("SET", "key", "value", "EX", "-1")
+	c.expect("-ERR invalid expire time in 'set' command\r\n")
+
+	time.Sleep(60 * time.Millisecond)
+	c.command("MGET", "short", "key")
+	c.expect("*2\r\n$-1\r\n$-1\r\n")
+}
+
+func TestRespServer_InlineAndPipeline(t *testing.T) {
+	c := newTestRespClient(t, nil)
+
+	c.send("SET inline value\r\nGET inline\r\n")
+	c.expect("+OK\r\n$5\r\nvalue\r\n")
+
+	c.send("*1\r\n$4\r\nPING\r\n*2\r\n$3\r\nGET\r\n$6\r\ninline\r\n")
+	c.expect("+PONG\r\n$5\r\nvalue\r\n")
+
+	c.send("*1\r\n#4\r\n")
+	c.expect("-ERR Protocol error: expected '$', got '#'\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("Connection is not closed after a protocol error: %v", err)
+	}
+}
+
+func TestRespServer_Limits(t *testing.T) {
+	c := newTestRespClient(t, nil)
+
+	c.send("*-1\r\n*0\r\n*-100\r\n*1\r\n$4\r\nPING\r\n")
+	c.expect("+PONG\r\n")
+
+	// every bulk is within its limit, the command is not: it is rejected
+	// at the header of the bulk over the limit
+	header := "$" + strconv.Itoa(maxBodySize) + "\r\n"
+	n := maxRespCommand/maxBodySize + 1
+	c.send("*" + strconv.Itoa(n+1) + "\r\n$3\r\nDEL\r\n" +
+		strings.Repeat(header+strings.Repeat("v", maxBodySize)+"\r\n", n-1) + header)
+	c.expect("-ERR Protocol error: too big request\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("Connection is not closed after a too big request: %v", err)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "admin:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b", "xxaxxb", true},
+		{"*a*b", "xxaxxbx", false},
+		{"a*", "", false},
+		{"*", "", true},
+		{"[abc", "[abc", true},
+		{strings.Repeat("*a", 50) + "b", strings.Repeat("a", 5000), false},
+	} {
+		if got := matchGlob(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("matchGlob(%q, %q) = %t", tc.pattern, tc.s, got)
+		}
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	for _, key := range []string{"", "0", "key", "\x00\xff"} {
+		cursor := encodeScanCursor(key)
+		if got, started, err := decodeScanCursor(cursor); err != nil || !started || got != key {
+			t.Errorf("Cursor %q of %q is decoded to %q, %t, %v", cursor, key, got, started, err)
+		}
+	}
+	for _, cursor := range []string{"", "1256", "2097", "10x1"} {
+		if _, _, err := decodeScanCursor(cursor); err == nil {
+			t.Errorf("Cursor %q is accepted", cursor)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The admin API manages the backends at runtime, the changes last until
+// the backends file is reloaded:
+//
+//	GET    /backends                 list the backends and their state
+//	POST   /backends                 add a backend, the body is its config
+//	GET    /backends/{addr}          show the backend
+//	DELETE /backends/{addr}          remove the backend
+//	PUT    /backends/{addr}/weight   set the weight, {"weight": 2}
+//	POST   /backends/{addr}/drain    stop passing new requests to it
+//	DELETE /backends/{addr}/drain    resume passing requests to it
+//	GET    /metrics                  metrics in the Prometheus format
+//
+// Requests are authenticated with "Authorization: Bearer <token>".
+const maxAdminBody = 64 << 10
+
+type backendStatus struct {
+	Address   string   `json:"address"`
+	Weight    int      `json:"weight"`
+	Tags      []string `json:"tags"`
+	Healthy   bool     `json:"healthy"`
+	Draining  bool     `json:"draining"`
+	Ejected   bool     `json:"ejected"`
+	InFlight  int64    `json:"in_flight"`
+	LatencyMs float64  `json:"latency_ms"`
+}
+
+// status reads the tags, so the lock of the pool must be held.
+func (s *server) status() backendStatus {
+	tags := s.tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return backendStatus{
+		Address:   s.addr,
+		Weight:    s.getWeight(),
+		Tags:      tags,
+		Healthy:   s.healthy(),
+		Draining:  s.isDraining(),
+		Ejected:   s.isEjected(),
+		InFlight:  s.load(),
+		LatencyMs: float64(s.getLatency()) / float64(time.Millisecond),
+	}
+}
+
+func (p *backendPool) status(s *server) backendStatus {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return s.status()
+}
+
+// list returns the state of all the backends.
+func (p *backendPool) list() []backendStatus {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	res := make([]backendStatus, 0, len(p.hosts))
+	for _, s := range p.hosts {
+		res = append(res, s.status())
+	}
+	return res
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func writeAdminError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, adminError{Error: err.Error()})
+}
+
+func readAdminJSON(rw http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxAdminBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(rw http.ResponseWriter, allow string) {
+	rw.Header().Set("Allow", allow)
+	writeJSON(rw, http.StatusMethodNotAllowed, adminError{Error: "method is not allowed, use " + allow})
+}
+
+// adminHandler serves the admin API for the clients with the token.
+func adminHandler(pool *backendPool, registry http.Handler, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	mux.HandleFunc("/backends", func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(rw, http.StatusOK, pool.list())
+		case http.MethodPost:
+			var b backendConfig
+			if !readAdminJSON(rw, r, &b) {
+				return
+			}
+			if s, err := pool.add(b); err == errBackendExists {
+				writeAdminError(rw, http.StatusConflict, err)
+			} else if err != nil {
+				writeAdminError(rw, http.StatusBadRequest, err)
+			} else {
+				writeJSON(rw, http.StatusCreated, pool.status(s))
+			}
+		default:
+			methodNotAllowed(rw, "GET, POST")
+		}
+	})
+	mux.HandleFunc("/backends/", func(rw http.ResponseWriter, r *http.Request) {
+		addr := strings.TrimPrefix(r.URL.Path, "/backends/")
+		action := ""
+		if i := strings.Index(addr, "/"); i >= 0 {
+			addr, action = addr[:i], addr[i+1:]
+		}
+		s := pool.find(addr)
+		if s == nil {
+			writeAdminError(rw, http.StatusNotFound, errNoBackend)
+			return
+		}
+		switch action {
+		case "":
+			handleBackend(rw, r, pool, s)
+		case "weight":
+			handleWeight(rw, r, pool, s)
+		case "drain":
+			handleDrain(rw, r, pool, s)
+		default:
+			http.NotFound(rw, r)
+		}
+	})
+	return requireToken(token, mux)
+}
+
+func handleBackend(rw http.ResponseWriter, r *http.Request, pool *backendPool, s *server) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, pool.status(s))
+	case http.MethodDelete:
+		if err := pool.remove(s.addr); err != nil {
+			writeAdminError(rw, http.StatusNotFound, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(rw, "GET, DELETE")
+	}
+}
+
+func handleWeight(rw http.ResponseWriter, r *http.Request, pool *backendPool, s *server) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(rw, http.MethodPut)
+		return
+	}
+	var req struct {
+		Weight *int `json:"weight"`
+	}
+	if !readAdminJSON(rw, r, &req) {
+		return
+	}
+	if req.Weight == nil {
+		writeJSON(rw, http.StatusBadRequest, adminError{Error: "weight is not set"})
+		return
+	}
+	// zero means the default weight only in the configuration
+	if *req.Weight < 1 {
+		writeJSON(rw, http.StatusBadRequest, adminError{Error: "weight must be at least 1"})
+		return
+	}
+	if err := validateBackend(backendConfig{Address: s.addr, Weight: *req.Weight}); err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	s.setWeight(*req.Weight)
+	writeJSON(rw, http.StatusOK, pool.status(s))
+}
+
+// handleDrain stops or resumes passing new requests to the backend, the
+// in-flight count of the status shows when the drained one is idle.
+func handleDrain(rw http.ResponseWriter, r *http.Request, pool *backendPool, s *server) {
+	switch r.Method {
+	case http.MethodPost:
+		s.setDraining(true)
+	case http.MethodDelete:
+		s.setDraining(false)
+	default:
+		methodNotAllowed(rw, "POST, DELETE")
+		return
+	}
+	writeJSON(rw, http.StatusOK, pool.status(s))
+}
+
+func requireToken(token string, h http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="lb-admin"`)
+			writeJSON(rw, http.StatusUnauthorized, adminError{Error: "missing or wrong token"})
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
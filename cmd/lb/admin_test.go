@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SofiaMazur/razur_s2_lab3/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAdminToken = "secret"
+
+func newTestAdmin(t *testing.T) (*backendPool, *httptest.Server) {
+	pool := newBackendPool(newTestChecker(func(string) bool { return true }, time.Hour))
+	pool.update(defaultPoolConfig([]string{"a:1", "b:1"}))
+	for _, s := range *pool.snapshot() {
+		s.setHealthy(true)
+	}
+	srv := httptest.NewServer(adminHandler(pool, metrics.NewRegistry(), testAdminToken))
+	t.Cleanup(func() {
+		srv.Close()
+		pool.close()
+	})
+	return pool, srv
+}
+
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, body string, out interface{}) int {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	_, srv := newTestAdmin(t)
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/backends", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+		assert.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestAdmin_Backends(t *testing.T) {
+	pool, srv := newTestAdmin(t)
+
+	var list []backendStatus
+	assert.Equal(t, http.StatusOK, adminRequest(t, srv, http.MethodGet, "/backends", "", &list))
+	assert.Len(t, list, 2)
+	assert.Equal(t, "a:1", list[0].Address)
+	assert.Equal(t, 1, list[0].Weight)
+	assert.True(t, list[0].Healthy)
+
+	var status backendStatus
+	assert.Equal(t, http.StatusCreated, adminRequest(t, srv, http.MethodPost, "/backends",
+		`{"address": "c:1", "weight": 3, "tags": ["canary"]}`, &status))
+	assert.Equal(t, backendStatus{Address: "c:1", Weight: 3, Tags: []string{"canary"}}, status)
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, addrs(pool.snapshot()))
+	assert.Len(t, pool.checkers, 3)
+
+	var failure adminError
+	assert.Equal(t, http.StatusConflict, adminRequest(t, srv, http.MethodPost, "/backends", `{"address": "c:1"}`, &failure))
+	assert.Equal(t, errBackendExists.Error(), failure.Error)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, srv, http.MethodPost, "/backends", `{"address": "c"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, srv, http.MethodPost, "/backends", `{"addr": "d:1"}`, nil))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, srv, http.MethodGet, "/backends/b:1", "", &status))
+	assert.Equal(t, "b:1", status.Address)
+	assert.Equal(t, []string{}, status.Tags)
+
+	assert.Equal(t, http.StatusNoContent, adminRequest(t, srv, http.MethodDelete, "/backends/a:1", "", nil))
+	assert.Equal(t, []string{"b:1", "c:1"}, addrs(pool.snapshot()))
+	assert.Len(t, pool.checkers, 2)
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, srv, http.MethodGet, "/backends/a:1", "", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, srv, http.MethodPut, "/backends", "", nil))
+}
+
+func TestAdmin_Weight(t *testing.T) {
+	pool, srv := newTestAdmin(t)
+	s := pool.find("a:1")
+
+	var status backendStatus
+	assert.Equal(t, http.StatusOK, adminRequest(t, srv, http.MethodPut, "/backends/a:1/weight", `{"weight": 5}`, &status))
+	assert.Equal(t, 5, status.Weight)
+	assert.Equal(t, 5, s.getWeight())
+
+	for _, body := range []string{`{"weight": -1}`, `{"weight": 0}`, `{"weight": 1001}`, `{}`, `{"weight": "5"}`} {
+		assert.Equal(t, http.StatusBadRequest, adminRequest(t, srv, http.MethodPut, "/backends/a:1/weight", body, nil), body)
+	}
+	assert.Equal(t, 5, s.getWeight())
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(t, srv, http.MethodGet, "/backends/a:1/weight", "", nil))
+}
+
+func TestAdmin_Drain(t *testing.T) {
+	pool, srv := newTestAdmin(t)
+	a := pool.find("a:1")
+	a.inFlight = 1
+
+	var status backendStatus
+	assert.Equal(t, http.StatusOK, adminRequest(t, srv, http.MethodPost, "/backends/a:1/drain", "", &status))
+	assert.True(t, status.Draining)
+	assert.Equal(t, int64(1), status.InFlight)
+	// the drained server gets no new requests
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		s, err := balance(pool.snapshot(), pathHash{}, path)
+		assert.Nil(t, err)
+		assert.Equal(t, "b:1", s.addr)
+	}
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, srv, http.MethodDelete, "/backends/a:1/drain", "", &status))
+	assert.False(t, status.Draining)
+	assert.Len(t, pool.snapshot().healthyServers(), 2)
+}
@@ -9,10 +9,13 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/razur_s2_lab3/httptools"
-	"github.com/razur_s2_lab3/signal"
+	"github.com/SofiaMazur/razur_s2_lab3/httptools"
+	"github.com/SofiaMazur/razur_s2_lab3/metrics"
+	"github.com/SofiaMazur/razur_s2_lab3/signal"
 )
 
 var (
@@ -20,14 +23,39 @@ var (
 	timeoutSec   = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https        = flag.Bool("https", false, "whether backends support HTTPs")
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
-	timeout      = time.Duration(*timeoutSec) * time.Second
-	serversPool  = []string{
+	strategyName = flag.String("strategy", "rendezvous", "load balancing strategy: "+strategyNames())
+	backendsFile = flag.String("backends", "", "JSON file with the backends, reloaded on SIGHUP and on changes; the compose servers are used when it is empty")
+	reloadPeriod = flag.Duration("reload-interval", 5*time.Second, "how often the backends file is checked for changes")
+	adminAddr    = flag.String("admin-addr", "", "address of the admin API, e.g. localhost:9090; it is disabled when empty")
+	metricsAddr  = flag.String("metrics-addr", "", "address serving /metrics without the admin token, e.g. :9100; the metrics are also served by the admin API")
+	// health checks
+	healthInterval     = flag.Duration("health-interval", 10*time.Second, "how often the backends are probed")
+	healthTimeout      = flag.Duration("health-timeout", 3*time.Second, "timeout of a health probe")
+	healthyThreshold   = flag.Int("healthy-threshold", 2, "consecutive successful probes to mark a backend healthy")
+	unhealthyThreshold = flag.Int("unhealthy-threshold", 3, "consecutive failed probes to mark a backend unhealthy")
+	// outlier detection
+	outlierErrors      = flag.Int("outlier-consecutive-errors", 5, "failed requests in a row to eject a backend, 0 disables the check")
+	outlierErrorRate   = flag.Float64("outlier-error-rate", 0.5, "share of failed requests in an interval to eject a backend, 0 disables the check")
+	outlierMinRequests = flag.Int("outlier-min-requests", 10, "requests of a backend in an interval to check its error rate and latency")
+	outlierLatency     = flag.Float64("outlier-latency-factor", 3, "times the median latency to eject a backend, 0 disables the check")
+	outlierInterval    = flag.Duration("outlier-interval", 10*time.Second, "how often the backends are evaluated by the outlier detection")
+	outlierEjection    = flag.Duration("outlier-base-ejection", 30*time.Second, "time of the first ejection, it doubles with every next one")
+	outlierMaxEjection = flag.Duration("outlier-max-ejection", 5*time.Minute, "maximum ejection time")
+	outlierMaxPercent  = flag.Int("outlier-max-ejected-percent", 50, "share of the backends which may be ejected at once")
+	// timeout is set from timeoutSec once the flags are parsed
+	timeout     = 3 * time.Second
+	serversPool = []string{
 		"server1:8080",
 		"server2:8080",
 		"server3:8080",
 	}
 )
 
+// confAdminToken holds the token of the admin API clients
+const confAdminToken = "LB_ADMIN_TOKEN"
+
+const shutdownTimeout = 5 * time.Second
+
 func scheme() string {
 	if *https {
 		return "https"
@@ -35,20 +63,23 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+func health(ctx context.Context, dst string) bool {
 	req, _ := http.NewRequestWithContext(ctx, "GET",
 		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
 	if resp, err := http.DefaultClient.Do(req); err != nil {
 		log.Println(err.Error())
 		return false
 	} else {
+		resp.Body.Close()
 		return resp.StatusCode == http.StatusOK
 	}
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+// forward passes the request to the backend and returns the status of its
+// response, the error is set when the backend can't be reached.
+func forward(dst string, rw http.ResponseWriter, r *http.Request) (int, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = dst
@@ -59,7 +90,7 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		log.Printf("Failed to get response from %s: %s", dst, err)
 		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
+		return 0, err
 	}
 
 	for k, values := range resp.Header {
@@ -77,7 +108,7 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 		log.Printf("Failed to write response: %s", err)
 	}
 
-	return nil
+	return resp.StatusCode, nil
 }
 
 func hashPath(urlPath string) uint64 {
@@ -86,44 +117,131 @@ func hashPath(urlPath string) uint64 {
 	return h64.Sum64()
 }
 
-func balance(healthPool *HostsHealth, url string) (string, error) {
-	healthyHosts := healthPool.GetHealthy()
-	healthyAmount := len(healthyHosts)
-	if healthyAmount == 0 {
-		return "", fmt.Errorf("no servers available")
+func balance(healthPool *HostsHealth, strategy Strategy, url string) (*server, error) {
+	healthyHosts := healthPool.healthyServers()
+	if len(healthyHosts) == 0 {
+		return nil, fmt.Errorf("no servers available")
 	}
-	idx := hashPath(url) % uint64(healthyAmount)
-	return healthyHosts[idx], nil
+	return strategy.Pick(healthyHosts, url), nil
 }
 
 func main() {
 	flag.Parse()
-	healthPool, _ := NewHealthChecker(&serversPool)
-
-	// TODO: Використовуйте дані про стан сервреа, щоб підтримувати список тих серверів, яким можна відправляти ззапит.
-	for i, _ := range serversPool {
-		i := i
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				isHealthy := health(serversPool[i])
-				healthPool.SetHealthState(i, isHealthy)
-				log.Println(serversPool[i], isHealthy)
-			}
-		}()
+	timeout = time.Duration(*timeoutSec) * time.Second
+	strategy, err := newStrategy(*strategyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *healthInterval <= 0 || *healthTimeout <= 0 || *healthyThreshold < 1 || *unhealthyThreshold < 1 {
+		log.Fatal("health check interval, timeout and thresholds must be positive")
+	}
+	if *outlierInterval <= 0 || *outlierEjection <= 0 || *outlierMaxEjection < *outlierEjection {
+		log.Fatal("outlier interval and ejection times must be positive, the maximum ejection can't be less than the base one")
+	}
+	if *outlierMaxPercent < 0 || *outlierMaxPercent > 100 {
+		log.Fatal("outlier max ejected percent must be in range 0..100")
 	}
+	pool := newBackendPool(&healthChecker{
+		probe:              health,
+		interval:           *healthInterval,
+		timeout:            *healthTimeout,
+		healthyThreshold:   *healthyThreshold,
+		unhealthyThreshold: *unhealthyThreshold,
+	})
+	stopWatch := make(chan struct{})
+	if *backendsFile != "" {
+		// a change made during the load is picked up by the watcher
+		version := statFile(*backendsFile)
+		if err := pool.reload(*backendsFile); err != nil {
+			log.Fatalf("Cannot load the backends: %s", err)
+		}
+		go pool.watchConfig(*backendsFile, version, *reloadPeriod, signal.NotifyReload(), stopWatch)
+	} else {
+		pool.update(defaultPoolConfig(serversPool))
+	}
+	pool.waitProbed()
+
+	registry := metrics.NewRegistry()
+	outliers := newOutlierDetector(outlierConfig{
+		consecutiveErrors: *outlierErrors,
+		errorRate:         *outlierErrorRate,
+		minRequests:       *outlierMinRequests,
+		latencyFactor:     *outlierLatency,
+		interval:          *outlierInterval,
+		baseEjection:      *outlierEjection,
+		maxEjection:       *outlierMaxEjection,
+		maxEjectedPercent: *outlierMaxPercent,
+	}, pool.snapshot, registry)
+	go outliers.run(stopWatch)
 
 	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		// TODO: Рееалізуйте свій алгоритм балансувальника.
-		if server, err := balance(healthPool, r.URL.Path); err != nil {
+		if server, err := balance(pool.snapshot(), strategy, r.URL.Path); err != nil {
 			rw.WriteHeader(http.StatusServiceUnavailable)
 			rw.Write([]byte(err.Error()))
 		} else {
-			forward(server, rw, r)
+			atomic.AddInt64(&server.inFlight, 1)
+			defer atomic.AddInt64(&server.inFlight, -1)
+			start := time.Now()
+			status, err := forward(server.addr, rw, r)
+			latency := time.Since(start)
+			if err == nil {
+				server.observeLatency(latency)
+			}
+			// the requests cancelled by the clients tell nothing of the backend
+			if r.Context().Err() == nil {
+				outliers.observe(server, err != nil || status >= http.StatusInternalServerError, latency)
+			}
 		}
 	}))
 
+	var admin, metricsServer httptools.Server
+	if *adminAddr != "" {
+		token := os.Getenv(confAdminToken)
+		if token == "" {
+			log.Fatalf("%s must be set to enable the admin API", confAdminToken)
+		}
+		admin = httptools.CreateServerAddr(*adminAddr, adminHandler(pool, registry, token))
+	}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		metricsServer = httptools.CreateServerAddr(*metricsAddr, mux)
+	}
+
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("Balancing strategy: %s", *strategyName)
 	frontend.Start()
+	if admin != nil {
+		log.Printf("Starting admin API on %s...", *adminAddr)
+		admin.Start()
+	}
+	if metricsServer != nil {
+		log.Printf("Serving metrics on %s...", *metricsAddr)
+		metricsServer.Start()
+	}
+	if admin == nil && metricsServer == nil {
+		log.Printf("Metrics of the outlier detection are not served, set -metrics-addr or -admin-addr")
+	}
 	signal.WaitForTerminationSignal()
+
+	// the frontend stops first, so the requests in flight are still
+	// observed by the outlier detection
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := frontend.Shutdown(ctx); err != nil {
+		log.Printf("Load balancer shutdown failed: %s", err)
+	}
+	if admin != nil {
+		if err := admin.Shutdown(ctx); err != nil {
+			log.Printf("Admin API shutdown failed: %s", err)
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			log.Printf("Metrics server shutdown failed: %s", err)
+		}
+	}
+	close(stopWatch)
+	pool.close()
 }
@@ -54,15 +54,15 @@ func TestBalancer(t *testing.T) {
 	healthPool.SetHealthState(0, false)
 	healthPool.SetHealthState(1, false)
 	healthPool.SetHealthState(2, false)
-	_, balancerErr := balance(healthPool, "/some-path")
+	_, balancerErr := balance(healthPool, pathHash{}, "/some-path")
 	assert.EqualError(t, balancerErr, "no servers available")
 
 	checkHashing := func() {
 		healthyLen := uint64(len(healthPool.GetHealthy()))
 		for _, route := range routes {
-			server, _ := balance(healthPool, route)
+			server, _ := balance(healthPool, pathHash{}, route)
 			expectedIndex := hashPath(route) % healthyLen
-			assert.Equal(t, server, serversPool[expectedIndex])
+			assert.Equal(t, server.addr, serversPool[expectedIndex])
 		}
 	}
 
@@ -87,8 +87,8 @@ func TestBalancer(t *testing.T) {
 	for i := 0; i < n; i++ {
 		for u, route := range resultRoutes {
 			expectedIndex := resultIndexes[u]
-			address, _ := balance(healthPool, route)
-			assert.Equal(t, address, serversPool[expectedIndex])
+			server, _ := balance(healthPool, pathHash{}, route)
+			assert.Equal(t, server.addr, serversPool[expectedIndex])
 		}
 	}
 }
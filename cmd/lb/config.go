@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// The backends file lists the servers of the pool:
+//
+//	{"backends": [
+//		{"address": "server1:8080", "weight": 2, "tags": ["blue"]},
+//		{"address": "server2:8080"}
+//	]}
+//
+// The weight is 1 when it is not set.
+type backendConfig struct {
+	Address string   `json:"address"`
+	Weight  int      `json:"weight,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+type poolConfig struct {
+	Backends []backendConfig `json:"backends"`
+}
+
+const maxWeight = 1000
+
+func loadPoolConfig(path string) (poolConfig, error) {
+	var cfg poolConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("malformed backends file: %s", err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg poolConfig) validate() error {
+	if len(cfg.Backends) == 0 {
+		return fmt.Errorf("no backends given")
+	}
+	seen := make(map[string]bool)
+	for _, b := range cfg.Backends {
+		if err := validateBackend(b); err != nil {
+			return err
+		}
+		if seen[b.Address] {
+			return fmt.Errorf("backend %s is listed twice", b.Address)
+		}
+		seen[b.Address] = true
+	}
+	return nil
+}
+
+func validateBackend(b backendConfig) error {
+	if _, _, err := net.SplitHostPort(b.Address); err != nil {
+		return fmt.Errorf("bad backend address %q: %s", b.Address, err)
+	}
+	if b.Weight < 0 || b.Weight > maxWeight {
+		return fmt.Errorf("backend %s: weight must be in range 0..%d", b.Address, maxWeight)
+	}
+	return nil
+}
+
+// defaultPoolConfig is the pool of the docker compose setup.
+func defaultPoolConfig(addrs []string) poolConfig {
+	var cfg poolConfig
+	for _, addr := range addrs {
+		cfg.Backends = append(cfg.Backends, backendConfig{Address: addr})
+	}
+	return cfg
+}
@@ -1,39 +1,214 @@
 package main
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
 
+// server is shared by the request handlers, the health checks and the
+// admin API, so its state is only accessed atomically.
 type server struct {
 	addr string
-	isHealthy bool
+	// isHealthy, draining and ejected are 0 or 1
+	isHealthy int32
+	// draining servers get no new requests
+	draining int32
+	// ejected servers are taken out by the outlier detection for a while
+	ejected int32
+	// weight is the share of the requests for the weighted strategies,
+	// it changes on reloads
+	weight int64
+	// tags are only changed under the lock of the pool
+	tags []string
+	// inFlight counts the forwarded requests which are not finished yet
+	inFlight int64
+	// latency is the moving average of the response time in nanoseconds
+	latency int64
 }
 
-type HostsHealth []server
+func setFlag(flag *int32, value bool) {
+	if value {
+		atomic.StoreInt32(flag, 1)
+	} else {
+		atomic.StoreInt32(flag, 0)
+	}
+}
+
+func (s *server) healthy() bool {
+	return atomic.LoadInt32(&s.isHealthy) == 1
+}
+
+func (s *server) setHealthy(healthy bool) {
+	setFlag(&s.isHealthy, healthy)
+}
+
+func (s *server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+func (s *server) setDraining(draining bool) {
+	setFlag(&s.draining, draining)
+}
+
+func (s *server) isEjected() bool {
+	return atomic.LoadInt32(&s.ejected) == 1
+}
+
+func (s *server) setEjected(ejected bool) {
+	setFlag(&s.ejected, ejected)
+}
+
+// available tells whether the server may take new requests.
+func (s *server) available() bool {
+	return s.healthy() && !s.isDraining() && !s.isEjected()
+}
+
+func (s *server) getWeight() int {
+	if w := atomic.LoadInt64(&s.weight); w > 0 {
+		return int(w)
+	}
+	return 1
+}
+
+func (s *server) setWeight(w int) {
+	atomic.StoreInt64(&s.weight, int64(w))
+}
+
+func (s *server) load() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+// latencyWeight is the share of a new response time in the average
+const latencyWeight = 8
+
+func (s *server) observeLatency(d time.Duration) {
+	for {
+		old := atomic.LoadInt64(&s.latency)
+		avg := int64(d)
+		if old != 0 {
+			avg = old + (int64(d)-old)/latencyWeight
+		}
+		if atomic.CompareAndSwapInt64(&s.latency, old, avg) {
+			return
+		}
+	}
+}
+
+func (s *server) getLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+// HostsHealth is the list of the backends, the servers are shared by the
+// lists built on reloads.
+type HostsHealth []*server
 
 func (h HostsHealth) SetHealthState(index int, state bool) error {
 	if (index >= len(h)) {
 		return errors.New("index out of range")
 	}
-	h[index].isHealthy = state
+	h[index].setHealthy(state)
 	return nil
 }
 
 func (h HostsHealth) GetHealthy() []string {
 	healthy := make([]string, 0)
 	for _, host := range h {
-		if host.isHealthy {
+		if host.healthy() {
 			healthy = append(healthy, host.addr)
 		}
 	}
 	return healthy
 }
 
+// healthyServers returns the servers which may take new requests in the
+// pool order.
+func (h HostsHealth) healthyServers() []*server {
+	healthy := make([]*server, 0, len(h))
+	for _, host := range h {
+		if host.available() {
+			healthy = append(healthy, host)
+		}
+	}
+	return healthy
+}
+
 func NewHealthChecker(addrs *[]string) (*HostsHealth, error) {
 	if (len(*addrs) == 0) {
 		return nil, errors.New("no addresses given")
 	}
 	var hosts HostsHealth
 	for _, host := range *addrs {
-		hosts = append(hosts, server{addr:host})
+		hosts = append(hosts, &server{addr:host})
 	}
 	return &hosts, nil
 }
+
+// healthChecker probes the backends periodically. A backend changes its
+// state after the number of the consecutive probes given by the thresholds,
+// so a single failure does not eject it. The first probe is done right
+// away and sets the state as is.
+type healthChecker struct {
+	probe    func(ctx context.Context, addr string) bool
+	interval time.Duration
+	timeout  time.Duration
+	// healthyThreshold and unhealthyThreshold are the numbers of the
+	// consecutive successful and failed probes to change the state
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+func (c *healthChecker) check(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return c.probe(ctx, addr)
+}
+
+// run checks the server until stop is closed, probed is closed after the
+// first probe.
+func (c *healthChecker) run(s *server, stop <-chan struct{}, probed chan<- struct{}) {
+	state := healthState{healthy: c.check(s.addr)}
+	s.setHealthy(state.healthy)
+	log.Printf("Backend %s is healthy: %t", s.addr, state.healthy)
+	close(probed)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if state.observe(c.check(s.addr), c.healthyThreshold, c.unhealthyThreshold) {
+			s.setHealthy(state.healthy)
+			log.Printf("Backend %s is healthy: %t", s.addr, state.healthy)
+		}
+	}
+}
+
+// healthState counts the consecutive probes which differ from the state.
+type healthState struct {
+	healthy bool
+	streak  int
+}
+
+// observe applies the probe result and tells whether the state changed.
+func (h *healthState) observe(ok bool, healthyThreshold, unhealthyThreshold int) bool {
+	if ok == h.healthy {
+		h.streak = 0
+		return false
+	}
+	h.streak++
+	threshold := healthyThreshold
+	if h.healthy {
+		threshold = unhealthyThreshold
+	}
+	if h.streak < threshold {
+		return false
+	}
+	h.healthy, h.streak = ok, 0
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestChecker changes the state on every probe.
+func newTestChecker(probe func(addr string) bool, interval time.Duration) *healthChecker {
+	return &healthChecker{
+		probe:              func(_ context.Context, addr string) bool { return probe(addr) },
+		interval:           interval,
+		timeout:            time.Second,
+		healthyThreshold:   1,
+		unhealthyThreshold: 1,
+	}
+}
+
+func TestHealthState_Thresholds(t *testing.T) {
+	state := healthState{healthy: true}
+	observe := func(ok bool) bool { return state.observe(ok, 2, 3) }
+
+	assert.False(t, observe(false))
+	assert.False(t, observe(false))
+	// a success resets the count of the failures
+	assert.False(t, observe(true))
+	assert.False(t, observe(false))
+	assert.False(t, observe(false))
+	assert.True(t, state.healthy)
+	assert.True(t, observe(false), "three failures in a row")
+	assert.False(t, state.healthy)
+
+	assert.False(t, observe(false))
+	assert.False(t, observe(true))
+	assert.True(t, observe(true), "two successes in a row")
+	assert.True(t, state.healthy)
+}
+
+func TestHealthChecker_InitialProbe(t *testing.T) {
+	checker := newTestChecker(func(string) bool { return true }, time.Hour)
+	pool := newBackendPool(checker)
+	defer pool.close()
+	pool.update(defaultPoolConfig([]string{"a:1", "b:1"}))
+	// the backends don't wait for the interval to become healthy
+	pool.waitProbed()
+	assert.Equal(t, []string{"a:1", "b:1"}, pool.snapshot().GetHealthy())
+}
+
+func TestHealthChecker_Timeout(t *testing.T) {
+	checker := &healthChecker{
+		probe: func(ctx context.Context, _ string) bool {
+			<-ctx.Done()
+			return false
+		},
+		timeout: 10 * time.Millisecond,
+	}
+	start := time.Now()
+	assert.False(t, checker.check("a:1"))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
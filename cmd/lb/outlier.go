@@ -0,0 +1,228 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SofiaMazur/razur_s2_lab3/metrics"
+)
+
+// outlierConfig sets when the backends are ejected by the outlier
+// detection. The zero thresholds disable their checks.
+type outlierConfig struct {
+	// consecutiveErrors ejects a backend right after the number of the
+	// failed requests in a row
+	consecutiveErrors int
+	// errorRate ejects a backend when the share of the failed requests in
+	// an interval is at least the rate, the interval must have minRequests
+	errorRate   float64
+	minRequests int
+	// latencyFactor ejects a backend when its mean latency in an interval
+	// is the factor times the median of the pool, which needs at least
+	// three backends with minRequests
+	latencyFactor float64
+	// interval is how often the backends are evaluated and returned
+	interval time.Duration
+	// the ejection time doubles with every ejection of the backend up to
+	// maxEjection, the count is reset when the backend stays in the pool for
+	// maxEjection after its return
+	baseEjection time.Duration
+	maxEjection  time.Duration
+	// maxEjectedPercent caps the share of the ejected backends, an ejection
+	// is allowed when the share after it is within the cap
+	maxEjectedPercent int
+}
+
+// outlierStats are the measurements of a backend.
+type outlierStats struct {
+	// the counts of the current interval
+	requests, failures int
+	latency            time.Duration
+	latencyCount       int
+
+	consecutive  int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// outlierDetector ejects the backends which fail or slow down the
+// forwarded requests, the active health checks may not notice them.
+type outlierDetector struct {
+	cfg   outlierConfig
+	hosts func() *HostsHealth
+	now   func() time.Time
+
+	mtx   sync.Mutex
+	stats map[*server]*outlierStats
+
+	ejections *metrics.Counter
+	ejected   *metrics.Gauge
+}
+
+func newOutlierDetector(cfg outlierConfig, hosts func() *HostsHealth, r *metrics.Registry) *outlierDetector {
+	return &outlierDetector{
+		cfg:       cfg,
+		hosts:     hosts,
+		now:       time.Now,
+		stats:     make(map[*server]*outlierStats),
+		ejections: r.NewCounter("lb_outlier_ejections_total", "Backends ejected by the outlier detection by reason.", "backend", "reason"),
+		ejected:   r.NewGauge("lb_outlier_ejected", "Whether the backend is ejected by the outlier detection.", "backend"),
+	}
+}
+
+func (d *outlierDetector) statsOf(s *server) *outlierStats {
+	st, ok := d.stats[s]
+	if !ok {
+		st = new(outlierStats)
+		d.stats[s] = st
+	}
+	return st
+}
+
+// observe records the result of a forwarded request, the latency is only
+// counted for the successful ones.
+func (d *outlierDetector) observe(s *server, failed bool, latency time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	st := d.statsOf(s)
+	st.requests++
+	if !failed {
+		st.consecutive = 0
+		st.latency += latency
+		st.latencyCount++
+		return
+	}
+	st.failures++
+	st.consecutive++
+	if d.cfg.consecutiveErrors > 0 && st.consecutive >= d.cfg.consecutiveErrors && !s.isEjected() {
+		d.eject(s, st, d.hosts(), "consecutive_errors")
+	}
+}
+
+// eject takes the backend out unless the ejection would exceed the cap of
+// the ejected backends or leave none. The lock must be held.
+func (d *outlierDetector) eject(s *server, st *outlierStats, hosts *HostsHealth, reason string) {
+	ejected := 0
+	for _, h := range *hosts {
+		if h.isEjected() {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > len(*hosts)*d.cfg.maxEjectedPercent || ejected+1 >= len(*hosts) {
+		log.Printf("Backend %s is an outlier (%s), but %d of %d backends are ejected already", s.addr, reason, ejected, len(*hosts))
+		return
+	}
+	st.ejections++
+	ejection := d.cfg.baseEjection
+	for i := 1; i < st.ejections && ejection < d.cfg.maxEjection; i++ {
+		ejection *= 2
+	}
+	if ejection > d.cfg.maxEjection {
+		ejection = d.cfg.maxEjection
+	}
+	st.ejectedUntil = d.now().Add(ejection)
+	st.consecutive = 0
+	s.setEjected(true)
+	d.ejections.Inc(s.addr, reason)
+	d.ejected.Set(1, s.addr)
+	log.Printf("Backend %s is ejected for %s (%s), ejection %d", s.addr, ejection, reason, st.ejections)
+}
+
+// evaluate returns the backends whose ejection is over, ejects the ones
+// with too many failures or too high latency in the interval and starts
+// a new interval.
+func (d *outlierDetector) evaluate() {
+	hosts := d.hosts()
+	now := d.now()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	current := make(map[*server]bool, len(*hosts))
+	for _, s := range *hosts {
+		current[s] = true
+		st := d.statsOf(s)
+		switch {
+		case s.isEjected() && !now.Before(st.ejectedUntil):
+			s.setEjected(false)
+			d.ejected.Set(0, s.addr)
+			log.Printf("Backend %s is returned after the ejection", s.addr)
+		case !s.isEjected() && st.ejections > 0 && now.Sub(st.ejectedUntil) >= d.cfg.maxEjection:
+			st.ejections = 0
+		}
+	}
+	// the removed backends are forgotten
+	addrs := make(map[string]bool, len(*hosts))
+	for _, s := range *hosts {
+		addrs[s.addr] = true
+	}
+	for s := range d.stats {
+		if !current[s] {
+			// a backend added again under the address keeps the series
+			if !addrs[s.addr] {
+				d.ejected.Delete(s.addr)
+			}
+			delete(d.stats, s)
+		}
+	}
+
+	if d.cfg.errorRate > 0 {
+		for _, s := range *hosts {
+			st := d.stats[s]
+			if !s.isEjected() && st.requests >= d.cfg.minRequests && st.requests > 0 &&
+				float64(st.failures) >= d.cfg.errorRate*float64(st.requests) {
+				d.eject(s, st, hosts, "error_rate")
+			}
+		}
+	}
+	if d.cfg.latencyFactor > 0 {
+		d.ejectSlow(hosts)
+	}
+	for _, st := range d.stats {
+		st.requests, st.failures = 0, 0
+		st.latency, st.latencyCount = 0, 0
+	}
+}
+
+func (d *outlierDetector) ejectSlow(hosts *HostsHealth) {
+	latencies := make(map[*server]time.Duration)
+	var sorted []time.Duration
+	for _, s := range *hosts {
+		st := d.stats[s]
+		if s.isEjected() || st.latencyCount == 0 || st.latencyCount < d.cfg.minRequests {
+			continue
+		}
+		mean := st.latency / time.Duration(st.latencyCount)
+		latencies[s] = mean
+		sorted = append(sorted, mean)
+	}
+	if len(sorted) < 3 {
+		return
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	limit := time.Duration(d.cfg.latencyFactor * float64(median))
+	for _, s := range *hosts {
+		if mean, ok := latencies[s]; ok && mean > limit {
+			d.eject(s, d.stats[s], hosts, "latency")
+		}
+	}
+}
+
+// run evaluates the backends every interval until stop is closed.
+func (d *outlierDetector) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.evaluate()
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SofiaMazur/razur_s2_lab3/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is moved by the tests.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestDetector(cfg outlierConfig, n int) (*outlierDetector, HostsHealth, *fakeClock, *metrics.Registry) {
+	hosts := newFakePool(make([]int, n)...)
+	r := metrics.NewRegistry()
+	d := newOutlierDetector(cfg, func() *HostsHealth { return &hosts }, r)
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	d.now = clock.now
+	return d, hosts, clock, r
+}
+
+func testOutlierConfig() outlierConfig {
+	return outlierConfig{
+		consecutiveErrors: 3,
+		interval:          time.Second,
+		baseEjection:      10 * time.Second,
+		maxEjection:       35 * time.Second,
+		maxEjectedPercent: 50,
+	}
+}
+
+func TestOutlier_ConsecutiveErrors(t *testing.T) {
+	d, hosts, clock, r := newTestDetector(testOutlierConfig(), 4)
+	s := hosts[0]
+
+	d.observe(s, true, 0)
+	d.observe(s, true, 0)
+	// a success resets the count
+	d.observe(s, false, time.Millisecond)
+	d.observe(s, true, 0)
+	d.observe(s, true, 0)
+	assert.False(t, s.isEjected())
+	d.observe(s, true, 0)
+	assert.True(t, s.isEjected())
+	assert.False(t, s.available())
+	assert.Len(t, hosts.healthyServers(), 3)
+
+	var text bytes.Buffer
+	r.WriteText(&text)
+	assert.Contains(t, text.String(), `lb_outlier_ejections_total{backend="`+s.addr+`",reason="consecutive_errors"} 1`)
+	assert.Contains(t, text.String(), `lb_outlier_ejected{backend="`+s.addr+`"} 1`)
+
+	clock.t = clock.t.Add(9 * time.Second)
+	d.evaluate()
+	assert.True(t, s.isEjected())
+	clock.t = clock.t.Add(time.Second)
+	d.evaluate()
+	assert.False(t, s.isEjected())
+	text.Reset()
+	r.WriteText(&text)
+	assert.Contains(t, text.String(), `lb_outlier_ejected{backend="`+s.addr+`"} 0`)
+}
+
+func TestOutlier_EjectionTime(t *testing.T) {
+	d, hosts, clock, _ := newTestDetector(testOutlierConfig(), 4)
+	s := hosts[0]
+	ejectFor := func() time.Duration {
+		for i := 0; i < 3; i++ {
+			d.observe(s, true, 0)
+		}
+		assert.True(t, s.isEjected())
+		return d.stats[s].ejectedUntil.Sub(clock.t)
+	}
+	returnAfter := func(d2 time.Duration) {
+		clock.t = clock.t.Add(d2)
+		d.evaluate()
+		assert.False(t, s.isEjected())
+	}
+
+	// the ejection time doubles up to the maximum
+	for _, expected := range []time.Duration{10 * time.Second, 20 * time.Second, 35 * time.Second, 35 * time.Second} {
+		assert.Equal(t, expected, ejectFor())
+		returnAfter(expected)
+	}
+	// the count is reset after the backend stays for the maximum ejection
+	returnAfter(35 * time.Second)
+	assert.Equal(t, 10*time.Second, ejectFor())
+}
+
+func TestOutlier_MaxEjectedPercent(t *testing.T) {
+	d, hosts, _, _ := newTestDetector(testOutlierConfig(), 4)
+	for _, s := range hosts {
+		for i := 0; i < 3; i++ {
+			d.observe(s, true, 0)
+		}
+	}
+	// an ejection is allowed while at most a half is ejected after it
+	assert.Equal(t, 2, countEjected(hosts))
+
+	d, hosts, _, _ = newTestDetector(testOutlierConfig(), 3)
+	for _, s := range hosts {
+		for i := 0; i < 3; i++ {
+			d.observe(s, true, 0)
+		}
+	}
+	assert.Equal(t, 1, countEjected(hosts))
+
+	// one backend is always left
+	cfg := testOutlierConfig()
+	cfg.maxEjectedPercent = 100
+	d, hosts, _, _ = newTestDetector(cfg, 2)
+	for _, s := range hosts {
+		for i := 0; i < 3; i++ {
+			d.observe(s, true, 0)
+		}
+	}
+	assert.Equal(t, 1, countEjected(hosts))
+
+	cfg = testOutlierConfig()
+	cfg.maxEjectedPercent = 0
+	d, hosts, _, _ = newTestDetector(cfg, 4)
+	for i := 0; i < 3; i++ {
+		d.observe(hosts[0], true, 0)
+	}
+	assert.False(t, hosts[0].isEjected())
+}
+
+func countEjected(hosts HostsHealth) int {
+	ejected := 0
+	for _, s := range hosts {
+		if s.isEjected() {
+			ejected++
+		}
+	}
+	return ejected
+}
+
+func TestOutlier_ErrorRate(t *testing.T) {
+	cfg := testOutlierConfig()
+	cfg.consecutiveErrors = 0
+	cfg.errorRate = 0.5
+	cfg.minRequests = 10
+	d, hosts, _, _ := newTestDetector(cfg, 3)
+
+	for i := 0; i < 10; i++ {
+		d.observe(hosts[0], i%2 == 0, time.Millisecond)
+		d.observe(hosts[1], i%3 == 0, time.Millisecond)
+	}
+	// too few requests to judge
+	for i := 0; i < 5; i++ {
+		d.observe(hosts[2], true, 0)
+	}
+	d.evaluate()
+	assert.True(t, hosts[0].isEjected())
+	assert.False(t, hosts[1].isEjected())
+	assert.False(t, hosts[2].isEjected())
+
+	// the counts start over every interval
+	for i := 0; i < 5; i++ {
+		d.observe(hosts[2], true, 0)
+	}
+	d.evaluate()
+	assert.False(t, hosts[2].isEjected())
+}
+
+func TestOutlier_Latency(t *testing.T) {
+	cfg := testOutlierConfig()
+	cfg.consecutiveErrors = 0
+	cfg.latencyFactor = 3
+	cfg.minRequests = 5
+	d, hosts, _, r := newTestDetector(cfg, 4)
+
+	latencies := []time.Duration{10, 12, 11, 40}
+	for i := 0; i < 5; i++ {
+		for j, s := range hosts {
+			d.observe(s, false, latencies[j]*time.Millisecond)
+		}
+	}
+	d.evaluate()
+	for j, s := range hosts {
+		assert.Equal(t, j == 3, s.isEjected(), s.addr)
+	}
+	var text bytes.Buffer
+	r.WriteText(&text)
+	assert.Equal(t, 1, strings.Count(text.String(), `reason="latency"} 1`))
+
+	// two backends are not enough to find the median
+	d, hosts, _, _ = newTestDetector(cfg, 2)
+	for i := 0; i < 5; i++ {
+		d.observe(hosts[0], false, 10*time.Millisecond)
+		d.observe(hosts[1], false, time.Second)
+	}
+	d.evaluate()
+	assert.False(t, hosts[1].isEjected())
+}
+
+func TestOutlier_RemovedBackends(t *testing.T) {
+	hosts := newFakePool(1, 1, 1)
+	r := metrics.NewRegistry()
+	d := newOutlierDetector(testOutlierConfig(), func() *HostsHealth { return &hosts }, r)
+	removed := hosts[2]
+	for i := 0; i < 3; i++ {
+		d.observe(removed, true, 0)
+	}
+	assert.True(t, removed.isEjected())
+	d.evaluate()
+	assert.Len(t, d.stats, 3)
+
+	hosts = hosts[:2]
+	d.evaluate()
+	assert.Len(t, d.stats, 2)
+	assert.NotContains(t, d.stats, removed)
+	var text bytes.Buffer
+	r.WriteText(&text)
+	assert.NotContains(t, text.String(), `backend="`+removed.addr+`"} `)
+}
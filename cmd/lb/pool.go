@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errBackendExists = errors.New("backend already exists")
+	errNoBackend     = errors.New("backend does not exist")
+)
+
+// backendPool keeps the backends of the balancer. Reloads replace the list
+// of the backends: the kept servers are shared with the old list, so the
+// requests in flight are not affected, and health checks are started and
+// stopped for the added and the removed ones.
+type backendPool struct {
+	mtx      sync.RWMutex
+	hosts    HostsHealth
+	checkers map[*server]checkerRun
+	wg       sync.WaitGroup
+
+	checker *healthChecker
+}
+
+// checkerRun controls the health checks of a server.
+type checkerRun struct {
+	stop   chan struct{}
+	probed chan struct{}
+}
+
+func newBackendPool(checker *healthChecker) *backendPool {
+	return &backendPool{
+		checkers: make(map[*server]checkerRun),
+		checker:  checker,
+	}
+}
+
+// snapshot returns the current list of the backends, it is never changed
+// by reloads.
+func (p *backendPool) snapshot() *HostsHealth {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	hosts := p.hosts
+	return &hosts
+}
+
+// find returns the backend with the address, it is nil when there is none.
+func (p *backendPool) find(addr string) *server {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	for _, s := range p.hosts {
+		if s.addr == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// add appends the backend to the pool.
+func (p *backendPool) add(b backendConfig) (*server, error) {
+	if err := validateBackend(b); err != nil {
+		return nil, err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, s := range p.hosts {
+		if s.addr == b.Address {
+			return nil, errBackendExists
+		}
+	}
+	s := &server{addr: b.Address, weight: int64(b.Weight), tags: b.Tags}
+	p.startChecker(s)
+	// the old list may be in use, so it is copied
+	hosts := make(HostsHealth, len(p.hosts), len(p.hosts)+1)
+	copy(hosts, p.hosts)
+	p.hosts = append(hosts, s)
+	return s, nil
+}
+
+// remove takes the backend out of the pool, its requests in flight are
+// finished.
+func (p *backendPool) remove(addr string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	hosts := make(HostsHealth, 0, len(p.hosts))
+	for _, s := range p.hosts {
+		if s.addr == addr {
+			close(p.checkers[s].stop)
+			delete(p.checkers, s)
+		} else {
+			hosts = append(hosts, s)
+		}
+	}
+	if len(hosts) == len(p.hosts) {
+		return errNoBackend
+	}
+	p.hosts = hosts
+	return nil
+}
+
+// update replaces the backends with the configured ones.
+func (p *backendPool) update(cfg poolConfig) (added, removed int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	current := make(map[string]*server, len(p.hosts))
+	for _, s := range p.hosts {
+		current[s.addr] = s
+	}
+	hosts := make(HostsHealth, 0, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		s, ok := current[b.Address]
+		if ok {
+			delete(current, b.Address)
+			s.setWeight(b.Weight)
+			s.tags = b.Tags
+		} else {
+			s = &server{addr: b.Address, weight: int64(b.Weight), tags: b.Tags}
+			p.startChecker(s)
+			added++
+		}
+		hosts = append(hosts, s)
+	}
+	for _, s := range current {
+		close(p.checkers[s].stop)
+		delete(p.checkers, s)
+		removed++
+	}
+	p.hosts = hosts
+	return added, removed
+}
+
+func (p *backendPool) startChecker(s *server) {
+	run := checkerRun{stop: make(chan struct{}), probed: make(chan struct{})}
+	p.checkers[s] = run
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.checker.run(s, run.stop, run.probed)
+	}()
+}
+
+// waitProbed waits for the first probes of the current backends, so they
+// don't start unhealthy. The probes are bounded by the checker timeout.
+func (p *backendPool) waitProbed() {
+	p.mtx.RLock()
+	probed := make([]chan struct{}, 0, len(p.checkers))
+	for _, run := range p.checkers {
+		probed = append(probed, run.probed)
+	}
+	p.mtx.RUnlock()
+	for _, ch := range probed {
+		<-ch
+	}
+}
+
+// close stops the health checks.
+func (p *backendPool) close() {
+	p.mtx.Lock()
+	for s, run := range p.checkers {
+		close(run.stop)
+		delete(p.checkers, s)
+	}
+	p.mtx.Unlock()
+	p.wg.Wait()
+}
+
+// reload applies the backends file, a broken file keeps the current pool.
+func (p *backendPool) reload(path string) error {
+	cfg, err := loadPoolConfig(path)
+	if err != nil {
+		return err
+	}
+	added, removed := p.update(cfg)
+	log.Printf("Backends reloaded from %s: %d total, %d added, %d removed", path, len(cfg.Backends), added, removed)
+	return nil
+}
+
+// fileVersion tells whether a file has changed.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{size: -1}
+	}
+	return fileVersion{info.ModTime(), info.Size()}
+}
+
+// watchConfig reloads the backends file when it differs from the loaded
+// version, or a value arrives from reloads. It returns when stop is closed.
+func (p *backendPool) watchConfig(path string, loaded fileVersion, interval time.Duration, reloads <-chan os.Signal, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-reloads:
+		case <-ticker.C:
+			if statFile(path) == loaded {
+				continue
+			}
+		}
+		loaded = statFile(path)
+		if err := p.reload(path); err != nil {
+			log.Printf("Failed to reload the backends: %s", err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func addrs(hosts *HostsHealth) []string {
+	res := make([]string, 0, len(*hosts))
+	for _, s := range *hosts {
+		res = append(res, s.addr)
+	}
+	return res
+}
+
+func writeBackends(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadPoolConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	writeBackends(t, path, `{"backends": [
+		{"address": "server1:8080", "weight": 2, "tags": ["blue"]},
+		{"address": "server2:8080"}
+	]}`)
+	cfg, err := loadPoolConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, poolConfig{Backends: []backendConfig{
+		{Address: "server1:8080", Weight: 2, Tags: []string{"blue"}},
+		{Address: "server2:8080"},
+	}}, cfg)
+
+	for _, content := range []string{
+		`{"backends": []}`,
+		`{"backends": [{"address": "server1"}]}`,
+		`{"backends": [{"address": "server1:8080", "weight": -1}]}`,
+		`{"backends": [{"address": "server1:8080"}, {"address": "server1:8080"}]}`,
+		`{"backends": `,
+	} {
+		writeBackends(t, path, content)
+		_, err := loadPoolConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestBackendPool_Update(t *testing.T) {
+	pool := newBackendPool(newTestChecker(func(string) bool { return true }, time.Hour))
+	defer pool.close()
+
+	added, removed := pool.update(defaultPoolConfig([]string{"a:1", "b:1", "c:1"}))
+	assert.Equal(t, 3, added)
+	assert.Equal(t, 0, removed)
+	before := pool.snapshot()
+	kept := (*before)[1]
+	kept.inFlight = 2
+
+	added, removed = pool.update(poolConfig{Backends: []backendConfig{
+		{Address: "b:1", Weight: 3, Tags: []string{"canary"}},
+		{Address: "d:1"},
+	}})
+	assert.Equal(t, 1, added)
+	assert.Equal(t, 2, removed)
+	after := pool.snapshot()
+	assert.Equal(t, []string{"b:1", "d:1"}, addrs(after))
+	// lists taken before the reload stay the same
+	assert.Equal(t, []string{"a:1", "b:1", "c:1"}, addrs(before))
+	// kept servers carry their requests in flight
+	assert.Same(t, kept, (*after)[0])
+	assert.Equal(t, int64(2), kept.load())
+	assert.Equal(t, 3, kept.getWeight())
+	assert.Equal(t, []string{"canary"}, kept.tags)
+	assert.Len(t, pool.checkers, 2)
+}
+
+func TestBackendPool_Checkers(t *testing.T) {
+	var (
+		mtx    sync.Mutex
+		probed = make(map[string]int)
+	)
+	pool := newBackendPool(newTestChecker(func(addr string) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		probed[addr]++
+		return addr == "a:1"
+	}, time.Millisecond))
+	pool.update(defaultPoolConfig([]string{"a:1", "b:1"}))
+	count := func(addr string) int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return probed[addr]
+	}
+	assert.Eventually(t, func() bool { return count("a:1") > 0 && count("b:1") > 0 }, time.Second, time.Millisecond)
+
+	pool.update(defaultPoolConfig([]string{"a:1"}))
+	stopped := count("b:1")
+	time.Sleep(20 * time.Millisecond)
+	// a probe may be running during the update
+	assert.LessOrEqual(t, count("b:1"), stopped+1)
+
+	pool.close()
+	assert.Equal(t, []string{"a:1"}, pool.snapshot().GetHealthy())
+}
+
+func TestBackendPool_WatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	writeBackends(t, path, `{"backends": [{"address": "a:1"}]}`)
+	pool := newBackendPool(newTestChecker(func(string) bool { return true }, time.Hour))
+	defer pool.close()
+	version := statFile(path)
+	assert.Nil(t, pool.reload(path))
+
+	reloads := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		pool.watchConfig(path, version, 5*time.Millisecond, reloads, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	writeBackends(t, path, `{"backends": [{"address": "a:1"}, {"address": "b:1"}]}`)
+	assert.Eventually(t, func() bool { return len(*pool.snapshot()) == 2 }, time.Second, time.Millisecond)
+
+	// broken files are ignored
+	writeBackends(t, path, `{"backends": [{"address": "a"}]}`)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, []string{"a:1", "b:1"}, addrs(pool.snapshot()))
+
+	// SIGHUP reloads the file right away
+	writeBackends(t, path, `{"backends": [{"address": "c:1"}]}`)
+	reloads <- os.Interrupt
+	assert.Eventually(t, func() bool {
+		hosts := pool.snapshot()
+		return len(*hosts) == 1 && (*hosts)[0].addr == "c:1"
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy chooses the backend of a request among the healthy ones. The
+// candidates are never empty and keep the order of the pool.
+type Strategy interface {
+	Pick(candidates []*server, path string) *server
+}
+
+var strategies = map[string]func() Strategy{
+	"round-robin":          func() Strategy { return new(roundRobin) },
+	"least-conn":           func() Strategy { return new(leastConn) },
+	"weighted-round-robin": func() Strategy { return newWeightedRoundRobin() },
+	"p2c":                  func() Strategy { return newTwoChoices(rand.Intn) },
+	"hash":                 func() Strategy { return pathHash{} },
+	"rendezvous":           func() Strategy { return rendezvous{} },
+}
+
+func strategyNames() string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newStrategy(name string) (Strategy, error) {
+	create, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %q, use one of %s", name, strategyNames())
+	}
+	return create(), nil
+}
+
+// roundRobin passes the requests to the backends in turn.
+type roundRobin struct {
+	next uint64
+}
+
+func (rr *roundRobin) Pick(candidates []*server, _ string) *server {
+	n := atomic.AddUint64(&rr.next, 1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// leastConn chooses the backend with the fewest requests in flight, the
+// ties are broken in turn.
+type leastConn struct {
+	next uint64
+}
+
+func (lc *leastConn) Pick(candidates []*server, _ string) *server {
+	start := int(atomic.AddUint64(&lc.next, 1) % uint64(len(candidates)))
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		s := candidates[(start+i)%len(candidates)]
+		if s.load() < best.load() {
+			best = s
+		}
+	}
+	return best
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: every
+// backend gets its share of the requests and the heavier ones are not
+// picked in bursts.
+type weightedRoundRobin struct {
+	mtx     sync.Mutex
+	current map[string]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: make(map[string]int)}
+}
+
+func (wrr *weightedRoundRobin) Pick(candidates []*server, _ string) *server {
+	wrr.mtx.Lock()
+	defer wrr.mtx.Unlock()
+	var (
+		best  *server
+		total int
+	)
+	for _, s := range candidates {
+		w := s.getWeight()
+		wrr.current[s.addr] += w
+		total += w
+		if best == nil || wrr.current[s.addr] > wrr.current[best.addr] {
+			best = s
+		}
+	}
+	wrr.current[best.addr] -= total
+	// removed and unhealthy backends start over when they are back
+	if len(wrr.current) > len(candidates) {
+		live := make(map[string]bool, len(candidates))
+		for _, s := range candidates {
+			live[s.addr] = true
+		}
+		for addr := range wrr.current {
+			if !live[addr] {
+				delete(wrr.current, addr)
+			}
+		}
+	}
+	return best
+}
+
+// twoChoices picks two random backends and passes the request to the one
+// with fewer requests in flight.
+type twoChoices struct {
+	mtx  sync.Mutex
+	intn func(n int) int
+}
+
+func newTwoChoices(intn func(n int) int) *twoChoices {
+	return &twoChoices{intn: intn}
+}
+
+func (tc *twoChoices) Pick(candidates []*server, _ string) *server {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	tc.mtx.Lock()
+	i := tc.intn(len(candidates))
+	j := tc.intn(len(candidates) - 1)
+	tc.mtx.Unlock()
+	if j >= i {
+		j++
+	}
+	if candidates[j].load() < candidates[i].load() {
+		return candidates[j]
+	}
+	return candidates[i]
+}
+
+// pathHash sends the same path to the same backend while the set of the
+// healthy backends stays the same.
+type pathHash struct{}
+
+func (pathHash) Pick(candidates []*server, path string) *server {
+	return candidates[hashPath(path)%uint64(len(candidates))]
+}
+
+// rendezvous is the weighted rendezvous hashing: every backend scores the
+// path and the best score wins. Unlike pathHash, only the paths of a
+// backend which leaves the pool move to other backends, the rest keep
+// their backends and caches.
+type rendezvous struct{}
+
+func (rendezvous) Pick(candidates []*server, path string) *server {
+	var (
+		best      *server
+		bestScore float64
+	)
+	for _, s := range candidates {
+		if score := rendezvousScore(s.addr, s.getWeight(), path); best == nil || score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best
+}
+
+// rendezvousScore turns the hash into a uniform number u in (0, 1), the
+// score -w/ln(u) makes the chance of winning proportional to the weight.
+func rendezvousScore(addr string, weight int, path string) float64 {
+	h := mix64(hashPath(addr + "\x00" + path))
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// mix64 is the finalizer of SplitMix64, it spreads the close FNV hashes
+// of the similar strings over all the bits.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
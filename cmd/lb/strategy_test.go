@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakePool builds a pool of healthy servers with the given weights.
+func newFakePool(weights ...int) HostsHealth {
+	pool := make(HostsHealth, len(weights))
+	for i, w := range weights {
+		pool[i] = &server{addr: fmt.Sprintf("server%d:8080", i+1), isHealthy: 1, weight: int64(w)}
+	}
+	return pool
+}
+
+// distribution counts the requests passed to every server.
+func distribution(pool HostsHealth, strategy Strategy, requests int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < requests; i++ {
+		s := strategy.Pick(pool.healthyServers(), fmt.Sprintf("/path%d", i))
+		counts[s.addr]++
+	}
+	return counts
+}
+
+func TestNewStrategy(t *testing.T) {
+	for name := range strategies {
+		s, err := newStrategy(name)
+		assert.Nil(t, err)
+		assert.NotNil(t, s)
+	}
+	_, err := newStrategy("random")
+	assert.Error(t, err)
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool := newFakePool(1, 1, 1)
+	assert.Equal(t, map[string]int{"server1:8080": 10, "server2:8080": 10, "server3:8080": 10},
+		distribution(pool, new(roundRobin), 30))
+
+	// unhealthy servers are skipped
+	pool[1].setHealthy(false)
+	assert.Equal(t, map[string]int{"server1:8080": 15, "server3:8080": 15},
+		distribution(pool, new(roundRobin), 30))
+}
+
+func TestLeastConn(t *testing.T) {
+	pool := newFakePool(1, 1, 1)
+	pool[0].inFlight = 5
+	pool[1].inFlight = 1
+	pool[2].inFlight = 3
+	lc := new(leastConn)
+	assert.Equal(t, "server2:8080", lc.Pick(pool.healthyServers(), "/").addr)
+
+	// the picked servers get busier, so the load evens out
+	for i := 0; i < 6; i++ {
+		lc.Pick(pool.healthyServers(), "/").inFlight++
+	}
+	for i := range pool {
+		assert.Equal(t, int64(5), pool[i].inFlight)
+	}
+
+	// equally loaded servers are picked in turn
+	pool = newFakePool(1, 1, 1)
+	assert.Equal(t, map[string]int{"server1:8080": 10, "server2:8080": 10, "server3:8080": 10},
+		distribution(pool, new(leastConn), 30))
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	pool := newFakePool(5, 1, 1)
+	wrr := newWeightedRoundRobin()
+	var order []string
+	for i := 0; i < 7; i++ {
+		order = append(order, wrr.Pick(pool.healthyServers(), "/").addr[:7])
+	}
+	// the heavy server is interleaved with the others
+	assert.Equal(t, []string{"server1", "server1", "server2", "server1", "server3", "server1", "server1"}, order)
+
+	pool = newFakePool(3, 2, 0)
+	assert.Equal(t, map[string]int{"server1:8080": 300, "server2:8080": 200, "server3:8080": 100},
+		distribution(pool, newWeightedRoundRobin(), 600))
+
+	// the state of the backends which are gone is dropped
+	assert.Len(t, wrr.current, 3)
+	wrr.Pick(pool[:1], "/")
+	assert.Len(t, wrr.current, 1)
+	assert.Contains(t, wrr.current, "server1:8080")
+}
+
+func TestTwoChoices(t *testing.T) {
+	pool := newFakePool(1, 1, 1)
+	tc := newTwoChoices(rand.New(rand.NewSource(1)).Intn)
+	// the busiest server is never the better choice
+	pool[2].inFlight = 10
+	counts := distribution(pool, tc, 3000)
+	assert.Equal(t, 0, counts["server3:8080"])
+	assert.InDelta(t, 1500, counts["server1:8080"], 150)
+	assert.InDelta(t, 1500, counts["server2:8080"], 150)
+
+	single := newFakePool(1)
+	assert.Equal(t, "server1:8080", tc.Pick(single.healthyServers(), "/").addr)
+}
+
+func TestPathHash(t *testing.T) {
+	pool := newFakePool(1, 1, 1)
+	for _, path := range []string{"/", "/a", "/a/b"} {
+		first := pathHash{}.Pick(pool.healthyServers(), path)
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, first, pathHash{}.Pick(pool.healthyServers(), path))
+		}
+	}
+	counts := distribution(pool, pathHash{}, 3000)
+	for addr, n := range counts {
+		assert.InDelta(t, 1000, n, 150, addr)
+	}
+}
+
+// remapped returns the fraction of the paths which change their server
+// when the last one leaves the pool.
+func remapped(strategy Strategy, servers, paths int) float64 {
+	pool := newFakePool(make([]int, servers)...)
+	before := make([]string, paths)
+	for i := range before {
+		before[i] = strategy.Pick(pool.healthyServers(), fmt.Sprintf("/path%d", i)).addr
+	}
+	pool[servers-1].setHealthy(false)
+	moved := 0
+	for i := range before {
+		if strategy.Pick(pool.healthyServers(), fmt.Sprintf("/path%d", i)).addr != before[i] {
+			moved++
+		}
+	}
+	return float64(moved) / float64(paths)
+}
+
+func TestRendezvous_Remapping(t *testing.T) {
+	// only the paths of the removed server move
+	assert.InDelta(t, 0.2, remapped(rendezvous{}, 5, 10000), 0.02)
+	assert.InDelta(t, 0.1, remapped(rendezvous{}, 10, 10000), 0.02)
+	// the modulo moves most of them
+	assert.Greater(t, remapped(pathHash{}, 5, 10000), 0.7)
+
+	pool := newFakePool(1, 1, 1, 1, 1)
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		path := fmt.Sprintf("/path%d", i)
+		before[path] = rendezvous{}.Pick(pool.healthyServers(), path).addr
+	}
+	pool[2].setHealthy(false)
+	for path, addr := range before {
+		if addr != pool[2].addr {
+			assert.Equal(t, addr, rendezvous{}.Pick(pool.healthyServers(), path).addr, path)
+		}
+	}
+}
+
+func TestRendezvous_Distribution(t *testing.T) {
+	counts := distribution(newFakePool(1, 1, 1, 1), rendezvous{}, 8000)
+	for addr, n := range counts {
+		assert.InDelta(t, 2000, n, 200, addr)
+	}
+	counts = distribution(newFakePool(3, 1), rendezvous{}, 8000)
+	assert.InDelta(t, 6000, counts["server1:8080"], 300)
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
-	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
-	"github.com/razur_s2_lab3/httptools"
-	"github.com/razur_s2_lab3/signal"
+	"github.com/SofiaMazur/razur_s2_lab3/dbclient"
+	"github.com/SofiaMazur/razur_s2_lab3/httptools"
+	"github.com/SofiaMazur/razur_s2_lab3/signal"
 )
 
 var port = flag.Int("port", 8080, "server port")
@@ -20,10 +21,6 @@ var port = flag.Int("port", 8080, "server port")
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
-type InData struct {
-	Value string
-}
-
 type OutData struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
@@ -31,22 +28,27 @@ type OutData struct {
 
 const baseUrl string = "http://db:8091"
 
+// confDbApiKey holds the API key of the db when it requires authentication
+const confDbApiKey = "DB_API_KEY"
+
+// the db may still be starting when the server is up
+const (
+	dbRetries = 5
+	dbBackoff = 200 * time.Millisecond
+)
+
 func main() {
-	client := http.DefaultClient
-	h := new(http.ServeMux)
-	var team InData
-	team.Value = time.Now().Format("01-02-2006")
-	bytedResponse, err := json.Marshal(&team)
+	flag.Parse()
+	client, err := dbclient.New(baseUrl,
+		dbclient.WithRetries(dbRetries, dbBackoff),
+		dbclient.WithAPIKey(os.Getenv(confDbApiKey)))
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
+	h := new(http.ServeMux)
 
-	response, err := client.Post(baseUrl+"/db/razur", "application/json", bytes.NewBuffer(bytedResponse))
-	if err != nil {
-		panic(err)
-	}
-	if response.StatusCode != http.StatusOK {
-		panic(response.Status)
+	if err := client.Put(context.Background(), "razur", time.Now().Format("01-02-2006")); err != nil {
+		log.Fatalf("Failed to store the team: %s", err)
 	}
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -72,24 +74,14 @@ func main() {
 
 		key := keys[0]
 
-		url := fmt.Sprintf(baseUrl+"/db/%s", key)
-		response, err := client.Get(url)
-		if err != nil {
-			panic(err)
-		}
-		if response.StatusCode != http.StatusOK {
-			http.Error(rw, "{}", response.StatusCode)
+		value, err := client.Get(r.Context(), key)
+		if errors.Is(err, dbclient.ErrNotFound) {
+			http.Error(rw, "{}", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to get %q: %s", key, err)
+			http.Error(rw, "{}", http.StatusBadGateway)
 			return
-		}
-		defer response.Body.Close()
-		body, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			panic(err)
-		}
-		var incoming InData
-		err = json.Unmarshal(body, &incoming)
-		if err != nil {
-			panic(err)
 		}
 		respDelayString := os.Getenv(confResponseDelaySec)
 		if delaySec, parseErr := strconv.Atoi(respDelayString); parseErr == nil && delaySec > 0 && delaySec < 300 {
@@ -98,7 +90,7 @@ func main() {
 
 		var outgoing OutData
 		outgoing.Key = key
-		outgoing.Value = incoming.Value
+		outgoing.Value = value
 		report.Process(r)
 
 		rw.Header().Set("content-type", "application/json")
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter answers whether a key may be present in a segment. False
+// positives are possible, false negatives are not.
+type bloomFilter struct {
+	k    uint32
+	bits []uint64
+}
+
+// bloomBitsPerKey gives about 1% of false positives.
+const bloomBitsPerKey = 10
+
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	k := uint32(math.Round(bloomBitsPerKey * math.Ln2))
+	return &bloomFilter{k: k, bits: make([]uint64, words)}
+}
+
+// locations uses double hashing to derive k bit positions of the key.
+func (bf *bloomFilter) locations(key recordKey, fn func(uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key.bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(key.key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (bf *bloomFilter) add(key recordKey) {
+	bf.locations(key, func(bit uint64) {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (bf *bloomFilter) mayContain(key recordKey) bool {
+	found := true
+	bf.locations(key, func(bit uint64) {
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+func (bf *bloomFilter) encode() []byte {
+	res := make([]byte, 8+len(bf.bits)*8)
+	binary.LittleEndian.PutUint32(res, bf.k)
+	binary.LittleEndian.PutUint32(res[4:], uint32(len(bf.bits)))
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(res[8+i*8:], word)
+	}
+	return res
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("corrupted bloom filter")
+	}
+	k := binary.LittleEndian.Uint32(data)
+	words := int(binary.LittleEndian.Uint32(data[4:]))
+	if words == 0 || len(data) != 8+words*8 {
+		return nil, fmt.Errorf("corrupted bloom filter")
+	}
+	bf := &bloomFilter{k: k, bits: make([]uint64, words)}
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[8+i*8:])
+	}
+	return bf, nil
+}
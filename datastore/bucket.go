@@ -0,0 +1,148 @@
+package datastore
+
+import "context"
+
+// maxBucketLen is the longest bucket name which fits into a record header.
+const maxBucketLen = 1<<16 - 1
+
+// Bucket is a named key space inside the database. Keys of different
+// buckets never collide, the records are kept apart by recovery and merge.
+type Bucket struct {
+	db   *Db
+	name string
+}
+
+// Bucket returns a handle for the named bucket. The empty name stands for
+// the default bucket used by Db.Get and Db.Put.
+func (db *Db) Bucket(name string) *Bucket {
+	return &Bucket{db: db, name: name}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.GetContext(context.Background(), key)
+}
+
+func (b *Bucket) GetContext(ctx context.Context, key string) (string, error) {
+	return b.db.get(ctx, recordKey{b.name, key})
+}
+
+func (b *Bucket) Put(key, value string) error {
+	return b.PutContext(context.Background(), key, value)
+}
+
+func (b *Bucket) PutContext(ctx context.Context, key, value string) error {
+	return b.db.write(ctx, entry{bucket: b.name, key: key, value: value})
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.DeleteContext(context.Background(), key)
+}
+
+func (b *Bucket) DeleteContext(ctx context.Context, key string) error {
+	return b.db.write(ctx, entry{bucket: b.name, key: key, flags: flagTombstone})
+}
+
+// Drop removes the whole bucket, see Db.DropBucket.
+func (b *Bucket) Drop() error {
+	return b.db.DropBucket(b.name)
+}
+
+func (b *Bucket) Stats() (BucketStats, error) {
+	stats, err := b.db.Stats()
+	return stats.Buckets[b.name], err
+}
+
+type BucketStats struct {
+	// Keys is the number of live keys.
+	Keys int
+	// Bytes is the disk space taken by the latest records of live keys.
+	Bytes int64
+	// RawBytes is the space the same records would take uncompressed.
+	RawBytes int64
+}
+
+// CompressionRatio returns how many times the data shrunk on disk.
+func (bs BucketStats) CompressionRatio() float64 {
+	if bs.Bytes == 0 {
+		return 1
+	}
+	return float64(bs.RawBytes) / float64(bs.Bytes)
+}
+
+type Stats struct {
+	// Segments is the number of sealed segment files.
+	Segments int
+	// Total sums up the stats of all the buckets.
+	Total   BucketStats
+	Buckets map[string]BucketStats
+}
+
+// Stats scans the indices of all the files. Only the snapshots of the
+// indices are taken under the lock, so reads and writes go on during the
+// scan.
+func (db *Db) Stats() (Stats, error) {
+	stats := Stats{Buckets: make(map[string]BucketStats)}
+	snapshots, err := db.snapshotIndices()
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		for _, s := range snapshots {
+			s.close()
+		}
+	}()
+	stats.Segments = len(snapshots) - 1
+
+	seen := make(map[recordKey]bool)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		err := snapshots[i].forEach(func(key recordKey, pos position) error {
+			if seen[key] || pos.deleted {
+				seen[key] = true
+				return nil
+			}
+			seen[key] = true
+			bs := stats.Buckets[key.bucket]
+			bs.Keys++
+			bs.Bytes += pos.size
+			bs.RawBytes += pos.rawSize
+			stats.Buckets[key.bucket] = bs
+			stats.Total.Keys++
+			stats.Total.Bytes += pos.size
+			stats.Total.RawBytes += pos.rawSize
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// snapshotIndices returns the snapshots of the indices from the oldest
+// file to the output one.
+func (db *Db) snapshotIndices() ([]indexSnapshot, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.snapshotIndicesLocked(getSortedKeys(db.params.index))
+}
+
+// snapshotIndicesLocked is snapshotIndices of the given files which is
+// called under the lock.
+func (db *Db) snapshotIndicesLocked(keys []string) ([]indexSnapshot, error) {
+	snapshots := make([]indexSnapshot, 0, len(keys))
+	for _, key := range keys {
+		s, err := db.params.index[key].snapshot()
+		if err != nil {
+			for _, s := range snapshots {
+				s.close()
+			}
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func mustStats(t *testing.T, db *Db) Stats {
+	t.Helper()
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestDb_Buckets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-buckets-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, teams := db.Bucket("users"), db.Bucket("teams")
+	if err := db.Put("key", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("key", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := teams.Put("key", "team"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("isolation", func(t *testing.T) {
+		expected := map[string]string{"": "default", "users": "user", "teams": "team"}
+		for name, value := range expected {
+			if found, err := db.Bucket(name).Get("key"); err != nil {
+				t.Errorf("Cannot get key from %q: %s", name, err)
+			} else if found != value {
+				t.Errorf("Bad value returned: expected %s, got %s", value, found)
+			}
+		}
+		if _, err := db.Bucket("other").Get("key"); err != ErrNotFound {
+			t.Errorf("Unexpected error for missing bucket: %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := users.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.Get("key"); err != ErrNotFound {
+			t.Errorf("Deleted key is still available: %v", err)
+		}
+		if found, err := db.Get("key"); err != nil || found != "default" {
+			t.Errorf("Delete affected another bucket: %s, %v", found, err)
+		}
+		if err := users.Put("key", "user"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		if err := teams.Put("other", "team"); err != nil {
+			t.Fatal(err)
+		}
+		stats := mustStats(t, db)
+		if keys := stats.Buckets["teams"].Keys; keys != 2 {
+			t.Errorf("Unexpected teams keys count %d", keys)
+		}
+		if users, err := users.Stats(); err != nil || users.Keys != 1 {
+			t.Errorf("Unexpected users keys count %d (%v)", users.Keys, err)
+		}
+		if keys := stats.Buckets["users"].Keys; keys != 1 {
+			t.Errorf("Unexpected users keys count %d", keys)
+		}
+		if stats.Buckets["teams"].Bytes <= 0 {
+			t.Errorf("Unexpected teams size %d", stats.Buckets["teams"].Bytes)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := teams.Drop(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := teams.Get("key"); err != ErrNotFound {
+			t.Errorf("Dropped key is still available: %v", err)
+		}
+		if _, ok := mustStats(t, db).Buckets["teams"]; ok {
+			t.Error("Dropped bucket is still reported")
+		}
+		if err := teams.Put("new", "team"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, testSizeBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found, err := db.Bucket("users").Get("key"); err != nil || found != "user" {
+			t.Errorf("Bad recovered value: %s, %v", found, err)
+		}
+		if _, err := db.Bucket("teams").Get("key"); err != ErrNotFound {
+			t.Errorf("Dropped key is recovered: %v", err)
+		}
+		if found, err := db.Bucket("teams").Get("new"); err != nil || found != "team" {
+			t.Errorf("Bad recovered value: %s, %v", found, err)
+		}
+	})
+}
+
+func TestDb_BucketsMerge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-buckets-merge-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	a, b := db.Bucket("a"), db.Bucket("b")
+	for key, value := range testValues {
+		if err := a.Put(key, value+"-a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(key, value+"-b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	// enough records to produce several segments and a merge
+	for i := 0; i < 3; i++ {
+		for key, value := range testValues {
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := a.Get("key1"); err != ErrNotFound {
+		t.Errorf("Deleted key survived the merge: %v", err)
+	}
+	for key, value := range testValues {
+		if key != "key1" {
+			if found, err := a.Get(key); err != nil || found != value+"-a" {
+				t.Errorf("Bad merged value: %s, %v", found, err)
+			}
+		}
+		if found, err := b.Get(key); err != nil || found != value+"-b" {
+			t.Errorf("Bad merged value: %s, %v", found, err)
+		}
+	}
+}
+
+func TestDb_GetMany(t *testing.T) {
+	db := newTestDb(t, "test-get-many-db", WithDiskIndex())
+	// the records are spread over several segments
+	for i := 0; i < 12; i++ {
+		if err := db.Put(fmt.Sprint("key", i), fmt.Sprint("value", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key1", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Bucket("other").Put("key3", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := db.GetMany([]string{"key0", "key1", "key2", "key3", "key11", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"key0": "value0", "key1": "updated", "key3": "value3", "key11": "value11"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Unexpected values %v", values)
+	}
+	values, err = db.Bucket("other").GetMany([]string{"key3", "key4"})
+	if err != nil || !reflect.DeepEqual(values, map[string]string{"key3": "other"}) {
+		t.Errorf("Unexpected bucket values %v, %v", values, err)
+	}
+}
@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// recordCodec transforms values between their plain form and the form
+// stored on disk.
+type recordCodec struct {
+	// compressThreshold is the minimal size of a compressed value,
+	// zero disables compression.
+	compressThreshold int
+	// keyring holds the encryption keys, values are stored in plain text
+	// when it is empty.
+	keyring Keyring
+	ciphers map[uint32]cipher.AEAD
+	// maxKeySize and maxValueSize limit the plain lengths of records.
+	maxKeySize, maxValueSize int
+}
+
+const (
+	DefaultMaxKeySize   = 64 << 10
+	DefaultMaxValueSize = 64 << 20
+
+	// the limits keep every record length within uint32 and the key
+	// length clear of extendedHeader
+	maxKeySizeLimit   = 16 << 20
+	maxValueSizeLimit = 1 << 30
+
+	// sealOverhead is the length of the AES-GCM nonce and tag
+	sealOverhead = 12 + 16
+)
+
+func (c *recordCodec) init() error {
+	if c.maxKeySize <= 0 || c.maxKeySize > maxKeySizeLimit {
+		return fmt.Errorf("max key size must be in range 1..%d", maxKeySizeLimit)
+	}
+	if c.maxValueSize <= 0 || c.maxValueSize > maxValueSizeLimit {
+		return fmt.Errorf("max value size must be in range 1..%d", maxValueSizeLimit)
+	}
+	if len(c.keyring.Keys) == 0 {
+		return nil
+	}
+	if _, ok := c.keyring.Keys[c.keyring.Current]; !ok {
+		return fmt.Errorf("current encryption key %d is not in the keyring", c.keyring.Current)
+	}
+	c.ciphers = make(map[uint32]cipher.AEAD)
+	for id, key := range c.keyring.Keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("encryption key %d: %s", id, err)
+		}
+		if c.ciphers[id], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSize validates the plain lengths of the entry.
+func (c *recordCodec) checkSize(e *entry) error {
+	if len(e.key) > c.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if len(e.value) > c.maxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// maxRecordSize returns the length of the longest record which may be
+// stored on disk.
+func (c *recordCodec) maxRecordSize() int {
+	return 12 + 20 + 3 + maxBucketLen + 4 + 8 + c.maxKeySize + c.maxValueSize + sealOverhead
+}
+
+// pack prepares the entry for writing: the value is replaced with its
+// stored form and the record flags are set accordingly.
+func (c *recordCodec) pack(e *entry) error {
+	if e.flags&(flagTombstone|flagDropBucket) != 0 {
+		return nil
+	}
+	if c.compressThreshold > 0 && len(e.value) >= c.compressThreshold {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(e.value)); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		if buf.Len() < len(e.value) {
+			e.value = buf.String()
+			e.flags |= flagCompressed
+		}
+	}
+	if c.ciphers != nil {
+		aead := c.ciphers[c.keyring.Current]
+		nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(e.value)+aead.Overhead())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		e.value = string(aead.Seal(nonce, nonce, []byte(e.value), additionalData(e)))
+		e.flags |= flagEncrypted
+		e.keyID = c.keyring.Current
+		// the plain text hash sum must not be exposed on disk
+		e.sum = getHashSum(e.key, e.value)
+	}
+	return nil
+}
+
+// unpack restores the plain value of the entry read from disk.
+func (c *recordCodec) unpack(e *entry) error {
+	encrypted := e.flags&flagEncrypted != 0
+	if encrypted {
+		if err := compareHash(e.key, e.value, e.sum); err != nil {
+			return err
+		}
+		aead, ok := c.ciphers[e.keyID]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrUnknownKey, e.keyID)
+		}
+		data := []byte(e.value)
+		if len(data) < aead.NonceSize() {
+			return ErrHashSums
+		}
+		nonce := data[:aead.NonceSize()]
+		value, err := aead.Open(nil, nonce, data[aead.NonceSize():], additionalData(e))
+		if err != nil {
+			return ErrHashSums
+		}
+		e.value = string(value)
+		e.flags &^= flagEncrypted
+		e.keyID = 0
+	}
+	if e.flags&flagCompressed != 0 {
+		r := flate.NewReader(bytes.NewReader([]byte(e.value)))
+		defer r.Close()
+		value, err := ioutil.ReadAll(io.LimitReader(r, int64(c.maxValueSize)+1))
+		if err != nil {
+			return err
+		}
+		if len(value) > c.maxValueSize {
+			return ErrValueTooLarge
+		}
+		e.value = string(value)
+		e.flags &^= flagCompressed
+	}
+	if encrypted {
+		// the stored sum covers the cipher text which is verified above
+		e.sum = getHashSum(e.key, e.value)
+	}
+	return nil
+}
+
+// additionalData binds the encrypted value to its key, so a value can't
+// be moved to another record unnoticed.
+func additionalData(e *entry) []byte {
+	return []byte(e.bucket + "\x00" + e.key)
+}
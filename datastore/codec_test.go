@@ -0,0 +1,205 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordCodec_Compression(t *testing.T) {
+	codec := recordCodec{compressThreshold: 16, maxKeySize: 16, maxValueSize: 1024}
+
+	short := entry{key: "key", value: "short"}
+	if err := codec.pack(&short); err != nil {
+		t.Fatal(err)
+	}
+	if short.flags&flagCompressed != 0 {
+		t.Error("short value must not be compressed")
+	}
+
+	value := strings.Repeat("compressible ", 20)
+	e := entry{key: "key", value: value}
+	if err := codec.pack(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.flags&flagCompressed == 0 || len(e.value) >= len(value) {
+		t.Fatalf("value is not compressed (%d bytes)", len(e.value))
+	}
+
+	var decoded entry
+	decoded.Decode(e.Encode())
+	if err := codec.unpack(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.value != value || decoded.flags != 0 {
+		t.Errorf("Bad unpacked entry %+v", decoded)
+	}
+
+	codec.maxValueSize = len(value) - 1
+	decoded.Decode(e.Encode())
+	if err := codec.unpack(&decoded); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge for an inflated value, got %v", err)
+	}
+}
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-compression-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	large := strings.Repeat("value", 100)
+
+	db, err := NewDb(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("old", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024*1024, WithCompression(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("new", large); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"old", "new"} {
+		if found, err := db.Get(key); err != nil || found != large {
+			t.Errorf("Cannot get %s: %v", key, err)
+		}
+	}
+	stats := mustStats(t, db).Total
+	if stats.RawBytes <= stats.Bytes || stats.CompressionRatio() <= 1 {
+		t.Errorf("Unexpected compression stats %+v", stats)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// compressed records are readable regardless of the settings
+	db, err = NewDb(dir, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"old", "new"} {
+		if found, err := db.Get(key); err != nil || found != large {
+			t.Errorf("Cannot get %s after reopening: %v", key, err)
+		}
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	keyring, err := ParseKeyring("# keys\n1:000102030405060708090a0b0c0d0e0f\n3:" + strings.Repeat("ab", 32) + ",2:" + strings.Repeat("cd", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Current != 3 || len(keyring.Keys) != 3 || len(keyring.Keys[3]) != 32 {
+		t.Errorf("Unexpected keyring %+v", keyring)
+	}
+	for _, bad := range []string{"1", "x:00", "1:zz", "1:00,1:00"} {
+		if _, err := ParseKeyring(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+// fileKeyIDs collects encryption key ids of all the records in the file.
+func fileKeyIDs(t *testing.T, path string) map[uint32]bool {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ids := make(map[uint32]bool)
+	in := bufio.NewReader(f)
+	for {
+		e, _, err := readEntry(in, 1<<20)
+		if err == io.EOF {
+			return ids
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if e.flags&flagEncrypted == 0 {
+			t.Errorf("Plain text record %s in %s", e.key, path)
+		}
+		ids[e.keyID] = true
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-encryption-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key1, key2 := []byte(strings.Repeat("1", 16)), []byte(strings.Repeat("2", 32))
+	first := Keyring{Current: 1, Keys: map[uint32][]byte{1: key1}}
+	rotated := Keyring{Current: 2, Keys: map[uint32][]byte{1: key1, 2: key2}}
+
+	db, err := NewDb(dir, testSizeBytes, WithEncryption(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range testValues {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, outFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("value1")) {
+		t.Error("Value is stored in plain text")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDb(dir, testSizeBytes); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected unknown key error, got %v", err)
+	}
+
+	db, err = NewDb(dir, testSizeBytes, WithEncryption(rotated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range testValues {
+		if found, err := db.Get(key); err != nil || found != value {
+			t.Errorf("Cannot get %s: %v", key, err)
+		}
+	}
+	// rotate the old records into segments and merge them
+	for i := 0; i < 4; i++ {
+		if err := db.Put(fmt.Sprintf("new%d", i), "new value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mustStats(t, db).Segments == 0 {
+		t.Fatal("No segments were created")
+	}
+	for fileName := range db.params.index {
+		if fileName != db.params.out && fileKeyIDs(t, fileName)[1] {
+			t.Errorf("Merged segment %s has records of the old key", fileName)
+		}
+	}
+	for key, value := range testValues {
+		if found, err := db.Get(key); err != nil || found != value {
+			t.Errorf("Cannot get %s after merge: %v", key, err)
+		}
+	}
+}
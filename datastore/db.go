@@ -2,7 +2,7 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Db struct {
@@ -19,26 +20,76 @@ type Db struct {
 	params       *storageEntries
 	mergeHandler *MergeHandler
 	writeHandler *WriteHandler
+	codec        recordCodec
+	metrics      Metrics
 	mtx          sync.Mutex
+	closeOnce    sync.Once
+	closed       chan struct{}
+	readOnly     bool
+	syncMode     SyncMode
+	// mergeThreshold is the number of sealed segments which starts a merge
+	mergeThreshold int
+	watchMtx     sync.Mutex
+	watchers     map[*Watcher]struct{}
+	// lock holds the LOCK file of the directory while the database is open
+	lock *os.File
 }
 
-func NewDb(dir string, sizeBytes int64) (*Db, error) {
+func NewDb(dir string, sizeBytes int64, opts ...Option) (db *Db, err error) {
+	db = &Db{
+		maxSize:        sizeBytes,
+		metrics:        nopMetrics{},
+		mergeThreshold: DefaultMergeThreshold,
+		codec: recordCodec{
+			maxKeySize:   DefaultMaxKeySize,
+			maxValueSize: DefaultMaxValueSize,
+		},
+		params: &storageEntries{
+			index: make(indexes),
+			drops: make(map[string][]string),
+		},
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.mergeThreshold < 0 || db.mergeThreshold == 1 {
+		return nil, fmt.Errorf("merge threshold must be zero or at least 2")
+	}
+	if err := db.codec.init(); err != nil {
+		return nil, err
+	}
+	if !db.readOnly {
+		if db.lock, err = lockDir(dir); err != nil {
+			return nil, err
+		}
+		lock := db.lock
+		defer func() {
+			if err != nil {
+				unlockDir(lock)
+			}
+		}()
+	}
+
 	outputPath := filepath.Join(dir, outFileName)
+	db.params.out = outputPath
+	db.closed = make(chan struct{})
+	if db.readOnly {
+		return db.openReadOnly(dir)
+	}
 	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
 
-	list, err := listStorageEntries(dir)
+	container, err := findContainer(dir)
 	if err != nil {
 		return nil, err
 	}
-	container := ""
-	for _, name := range list {
-		if strings.HasPrefix(name, containerName) {
-			container = name
-		}
-	}
 	if container == "" {
 		dirPath, err := ioutil.TempDir(dir, containerName)
 		if err != nil {
@@ -46,189 +97,557 @@ func NewDb(dir string, sizeBytes int64) (*Db, error) {
 		}
 		container = filepath.Base(dirPath)
 	}
-
-	storageEntries := &storageEntries{
-		index:     make(indexes),
-		out:       outputPath,
-		container: filepath.Join(dir, container),
+	// directories of older versions have no CURRENT file yet
+	if err = writeCurrentContainer(dir, container); err != nil {
+		return nil, err
 	}
 
-	db := &Db{
-		out:     f,
-		maxSize: sizeBytes,
-		params:  storageEntries,
-	}
-	db.mergeHandler = NewMergeHandler(storageEntries, &db.mtx)
+	db.out = f
+	db.params.container = filepath.Join(dir, container)
+	db.mergeHandler = NewMergeHandler(db.params, &db.codec, db.metrics, &db.mtx)
 	db.writeHandler = NewWriteHandler(db.onWriteListener)
 
+	err = db.recover()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// the loops start only when the database is complete, so a failed
+	// open leaves nothing running
 	go db.mergeHandler.StartLoop()
 	go db.writeHandler.StartLoop()
+	if db.shouldMerge() {
+		db.mergeHandler.Req <- true
+		<-db.mergeHandler.Res
+	}
+	db.reportStorage()
+	return db, nil
+}
 
-	err = db.recover()
+// OpenReadOnly opens the database in the directory for reading only, see
+// WithReadOnly.
+func OpenReadOnly(dir string, opts ...Option) (*Db, error) {
+	return NewDb(dir, 0, append(opts, WithReadOnly())...)
+}
+
+// openReadOnly recovers the index without creating any files or starting
+// the write and merge loops.
+func (db *Db) openReadOnly(dir string) (*Db, error) {
+	container, err := findContainer(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if container != "" {
+		db.params.container = filepath.Join(dir, container)
+		if list, err = listSegments(db.params.container); err != nil {
+			return nil, err
+		}
+	}
+	db.params.segmentCounter = len(list)
+	if _, err := os.Stat(db.params.out); os.IsNotExist(err) {
+		db.params.index[db.params.out] = make(hashIndex)
+		err = db.execRecover(list, false)
+	} else {
+		err = db.execRecover(list, true)
+	}
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	db.reportStorage()
 	return db, nil
 }
 
+// findContainer returns the name of the segments directory, or an empty
+// string if there is none yet. The CURRENT file names it, directories
+// without the file may have only one container.
+func findContainer(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, currentFileName))
+	if err == nil {
+		container := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(container, containerName) || filepath.Base(container) != container {
+			return "", fmt.Errorf("invalid %s file in %s", currentFileName, dir)
+		}
+		if _, err := os.Stat(filepath.Join(dir, container)); err != nil {
+			return "", err
+		}
+		return container, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	list, err := listStorageEntries(dir)
+	if err != nil {
+		return "", err
+	}
+	container := ""
+	for _, name := range list {
+		if strings.HasPrefix(name, containerName) {
+			if container != "" {
+				return "", fmt.Errorf("several containers and no %s file in %s", currentFileName, dir)
+			}
+			container = name
+		}
+	}
+	return container, nil
+}
+
+// writeCurrentContainer atomically replaces the CURRENT file of the
+// directory.
+func writeCurrentContainer(dir, container string) error {
+	path := filepath.Join(dir, currentFileName)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(container + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
 const bufSize = 8192
 
 func (db *Db) recover() error {
-	list, err := listStorageEntries(db.params.container)
+	list, err := listSegments(db.params.container)
 	if err != nil {
 		return err
 	}
 	db.params.segmentCounter = len(list)
 
-	err = db.execRecover(list)
-	if db.params.segmentCounter > 1 {
-		db.mergeHandler.Req <- true
-		<-db.mergeHandler.Res
-	}
-	return err
+	return db.execRecover(list, true)
 }
 
-func (db *Db) execRecover(dirEntries []string) error {
-	list := append(dirEntries, db.params.out)
+// execRecover indexes the segments of the container and, if withOut is
+// set, the output file.
+func (db *Db) execRecover(dirEntries []string, withOut bool) error {
+	list := dirEntries
+	if withOut {
+		list = append(list, db.params.out)
+	}
 	for _, name := range list {
 		if name != db.params.out {
 			name = filepath.Join(db.params.container, name)
+			info, err := os.Stat(name)
+			if err != nil {
+				return err
+			}
+			db.params.sealedSize += info.Size()
+			if db.params.sorted {
+				// sorted segments are produced by merges, so they never
+				// drop buckets of older segments
+				if si, err := loadSortedIndex(name, &db.codec); err == nil {
+					db.params.index[name] = si
+					continue
+				}
+			}
+			if db.params.diskIndex {
+				if di, err := loadDiskIndex(name); err == nil {
+					// buckets dropped by the segment apply to older ones
+					for _, bucket := range di.drops {
+						db.params.dropBucket(name, bucket)
+					}
+					db.params.index[name] = di
+					continue
+				}
+			}
 		}
-		db.params.index[name] = make(hashIndex)
-		var currentOffset int64
-		input, err := os.Open(name)
-		if err != nil {
+		if err := db.recoverFile(name); err != nil {
 			return err
 		}
-		defer input.Close()
-
-		var buf [bufSize]byte
-		in := bufio.NewReaderSize(input, bufSize)
-		for err == nil {
-			var (
-				header, data []byte
-				n            int
-			)
-			header, err = in.Peek(bufSize)
-			if err == io.EOF {
-				if len(header) == 0 {
-					continue
-				}
-			} else if err != nil {
+		if name != db.params.out && db.params.diskIndex && !db.readOnly {
+			if err := db.params.seal(name, &db.mtx); err != nil {
 				return err
 			}
-			size := binary.LittleEndian.Uint32(header)
-
-			if size < bufSize {
-				data = buf[:size]
-			} else {
-				data = make([]byte, size)
-			}
-			n, err = in.Read(data)
-
-			if err == nil {
-				if n != int(size) {
-					return fmt.Errorf("corrupted file")
-				}
+		}
+	}
+	return nil
+}
 
-				var e entry
-				e.Decode(data)
-				if err := compareHash(e.key, e.value, e.sum); err != nil {
-					return err
-				}
+// recoverFile builds the index of the file by reading all its records.
+func (db *Db) recoverFile(name string) error {
+	hash := make(hashIndex)
+	db.params.index[name] = hash
+	var currentOffset int64
+	input, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
 
-				db.params.index[name][e.key] = currentOffset
-				currentOffset += int64(n)
-			}
+	in := bufio.NewReaderSize(input, bufSize)
+	for {
+		e, n, err := readEntry(in, db.codec.maxRecordSize())
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("corrupted file")
+		} else if err != nil {
+			return err
 		}
-		if name == db.params.out {
-			db.outOffset = currentOffset
+		if err := db.codec.unpack(&e); err != nil {
+			return err
 		}
+		if err := compareHash(e.key, e.value, e.sum); err != nil {
+			return err
+		}
+		if err := db.codec.checkSize(&e); err != nil {
+			return fmt.Errorf("%s at offset %d: %w", name, currentOffset, err)
+		}
+
+		db.applyEntry(name, hash, &e, currentOffset, int64(n))
+		currentOffset += int64(n)
+	}
+	if name == db.params.out {
+		db.outOffset = currentOffset
 	}
 	return nil
 }
 
+// applyEntry registers the record written at the given offset of the file
+// in the index. The entry is expected to be unpacked already.
+func (db *Db) applyEntry(fileName string, hash hashIndex, e *entry, offset, size int64) {
+	if e.flags&flagDropBucket != 0 {
+		db.params.dropBucket(fileName, e.bucket)
+		return
+	}
+	hash[recordKey{e.bucket, e.key}] = position{
+		offset:  offset,
+		size:    size,
+		rawSize: int64(e.size()),
+		deleted: e.flags&flagTombstone != 0,
+	}
+}
+
+// Close stops accepting writes, waits for the queued ones and a running
+// merge to finish and closes the output file. Later calls return ErrClosed.
 func (db *Db) Close() error {
+	err := ErrClosed
+	db.closeOnce.Do(func() {
+		err = db.close()
+	})
+	return err
+}
+
+func (db *Db) close() error {
+	close(db.closed)
+	if db.readOnly {
+		return nil
+	}
+	// merges are only started by the write loop, so none is running once
+	// the loop exits
+	db.writeHandler.Close()
+	db.mergeHandler.Close()
+	db.stopWatchers()
+
+	defer unlockDir(db.lock)
+
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if err := db.out.Sync(); err != nil {
+		db.out.Close()
+		return err
+	}
 	if err := db.out.Close(); err != nil {
 		return err
 	}
 
+	// containers left by interrupted merges are not referenced by any
+	// index, they are removed only when CURRENT names the one in use
 	dir := filepath.Dir(db.params.out)
+	container := filepath.Base(db.params.container)
+	if current, err := findContainer(dir); err != nil || current != container {
+		return err
+	}
 	list, err := listStorageEntries(dir)
 	if err != nil {
 		return err
 	}
-	out := filepath.Base(db.params.out)
-	container := filepath.Base(db.params.container)
 	for _, name := range list {
-		if name != out && name != container {
-			fullPath := filepath.Join(dir, name)
-			if err := os.RemoveAll(fullPath); err != nil {
+		if strings.HasPrefix(name, containerName) && name != container {
+			if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
 				return err
 			}
 		}
 	}
-
-	db.mergeHandler.Close()
-
-	db.writeHandler.Close()
 	return nil
 }
 
 func (db *Db) Get(key string) (string, error) {
-  keys := getSortedKeys(db.params.index)
-  db.mtx.Lock()
-  // local copy for safe get operation
-  dbIndex := db.params.index
-  db.mtx.Unlock()
-  for i := len(keys) - 1; i >= 0; i-- {
-    fileName := keys[i]
-    position, ok := dbIndex[fileName][key]
-    if !ok {
-      continue
-    }
-
-		file, err := os.Open(fileName)
+	return db.get(context.Background(), recordKey{key: key})
+}
+
+// GetContext is Get which gives up when the context is done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	return db.get(ctx, recordKey{key: key})
+}
+
+// reportStorage passes the current size of the storage to the metrics.
+func (db *Db) reportStorage() {
+	db.mtx.Lock()
+	segments := len(db.params.index) - 1
+	bytes := db.params.sealedSize + db.outOffset
+	db.mtx.Unlock()
+	db.metrics.SetStorage(segments, bytes)
+}
+
+func (db *Db) Put(key, value string) error {
+	return db.write(context.Background(), entry{key: key, value: value})
+}
+
+// PutContext is Put which gives up when the context is done. The record
+// may still be written if the context is done after it was queued.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	return db.write(ctx, entry{key: key, value: value})
+}
+
+func (db *Db) Delete(key string) error {
+	return db.write(context.Background(), entry{key: key, flags: flagTombstone})
+}
+
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.write(ctx, entry{key: key, flags: flagTombstone})
+}
+
+// DropBucket removes all the records of the bucket. Only a single marker
+// record is written, the data itself is discarded by the next merge.
+func (db *Db) DropBucket(name string) error {
+	return db.write(context.Background(), entry{bucket: name, flags: flagDropBucket})
+}
+
+// isClosed tells whether Close was called.
+func (db *Db) isClosed() bool {
+	select {
+	case <-db.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// lookup finds the latest record of the key. The file holding it is opened
+// under the lock, so neither a rotation nor a merge can replace it before
+// the record is read.
+func (db *Db) lookup(key recordKey) (*os.File, position, bool, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	keys := getSortedKeys(db.params.index)
+	for i := len(keys) - 1; i >= 0; i-- {
+		pos, ok, err := db.params.index[keys[i]].find(key)
 		if err != nil {
-			return "", err
+			return nil, position{}, false, err
+		} else if !ok {
+			continue
 		}
-		defer file.Close()
-		value, hashSum, err := searchValue(file, position)
-		if err != nil {
-			return "", err
+		if pos.deleted {
+			return nil, pos, true, nil
 		}
-		if err := compareHash(key, value, hashSum); err != nil {
-			return "", err
-		} else {
-			return value, nil
+		file, err := os.Open(keys[i])
+		if err != nil {
+			return nil, position{}, false, err
 		}
+		return file, pos, true, nil
 	}
-	return "", ErrNotFound
+	return nil, position{}, false, nil
 }
 
-func (db *Db) Put(key, value string) error {
-	e := entry{
-		key:   key,
-		value: value,
-		sum:   getHashSum(key, value),
+func (db *Db) get(ctx context.Context, key recordKey) (value string, err error) {
+	defer func(start time.Time) {
+		db.metrics.ObserveGet(time.Since(start), err)
+	}(time.Now())
+
+	if db.isClosed() {
+		return "", ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if ctx.Done() == nil {
+		return db.read(key)
+	}
+	type result struct {
+		value string
+		err   error
+	}
+	res := make(chan result, 1)
+	go func() {
+		value, err := db.read(key)
+		res <- result{value, err}
+	}()
+	select {
+	case r := <-res:
+		return r.value, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// read finds the latest value of the key.
+func (db *Db) read(key recordKey) (string, error) {
+	e, err := db.readLatest(key)
+	return e.value, err
+}
+
+// readLatest returns the plain latest record of the key.
+func (db *Db) readLatest(key recordKey) (entry, error) {
+	file, pos, ok, err := db.lookup(key)
+	if err != nil {
+		return entry{}, err
+	}
+	if !ok || pos.deleted {
+		return entry{}, ErrNotFound
+	}
+	defer file.Close()
+	return db.loadRecord(file, pos)
+}
+
+// readRecord reads the plain value of the record at the position.
+func (db *Db) readRecord(file *os.File, pos position) (string, error) {
+	e, err := db.loadRecord(file, pos)
+	return e.value, err
+}
+
+// loadRecord reads and verifies the record at the position. Expired
+// records are reported with ErrNotFound.
+func (db *Db) loadRecord(file *os.File, pos position) (entry, error) {
+	e, err := searchEntry(file, pos.offset, db.codec.maxRecordSize())
+	if err != nil {
+		return entry{}, err
+	}
+	if err := db.codec.unpack(&e); err != nil {
+		return entry{}, err
+	}
+	if err := compareHash(e.key, e.value, e.sum); err != nil {
+		return entry{}, err
+	}
+	if e.expired(time.Now()) {
+		return entry{}, ErrNotFound
 	}
-	db.writeHandler.Req <- e
-	err := <-db.writeHandler.Res
+	return e, nil
+}
+
+func (db *Db) write(ctx context.Context, e entry) error {
+	start := time.Now()
+	err := db.writeBatch(ctx, []entry{e})
+	db.metrics.ObservePut(time.Since(start), err)
 	return err
 }
 
+// writeBatch passes all the entries to the write loop at once. Entries are
+// written in order, the first failure stops the batch.
+func (db *Db) writeBatch(ctx context.Context, batch []entry) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkBatch(batch); err != nil {
+		return err
+	}
+	return db.send(ctx, writeRequest{batch: batch})
+}
+
+// update runs prepare in the write loop and writes the entries it returns,
+// which makes read-modify-write operations atomic.
+func (db *Db) update(ctx context.Context, prepare func() ([]entry, error)) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.send(ctx, writeRequest{prepare: prepare})
+}
+
+// checkBatch validates the entries and sets their hash sums.
+func (db *Db) checkBatch(batch []entry) error {
+	for i := range batch {
+		if len(batch[i].bucket) > maxBucketLen {
+			return ErrInvalidBucket
+		}
+		if err := db.codec.checkSize(&batch[i]); err != nil {
+			return err
+		}
+		batch[i].sum = getHashSum(batch[i].key, batch[i].value)
+	}
+	return nil
+}
+
+// send passes the request to the write loop and waits for the result.
+func (db *Db) send(ctx context.Context, req writeRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	req.res = make(chan error, 1)
+	select {
+	case db.writeHandler.Req <- req:
+	case <-db.writeHandler.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (db *Db) onWriteListener() (closed bool) {
-	e, more := <-db.writeHandler.Req
-	if !more {
+	var req writeRequest
+	select {
+	case req = <-db.writeHandler.Req:
+	case <-db.writeHandler.done:
 		closed = true
 		return
 	}
-	encoded := e.Encode()
+	start := time.Now()
+	var (
+		err     error
+		written int64
+	)
+	batch := req.batch
+	if req.prepare != nil {
+		if batch, err = req.prepare(); err == nil {
+			err = db.checkBatch(batch)
+		}
+		if err != nil {
+			req.res <- err
+			return
+		}
+	}
+	for _, e := range batch {
+		var n int
+		if n, err = db.writeEntry(e); err != nil {
+			break
+		}
+		written += int64(n)
+		db.notify(&e)
+	}
+	if err == nil && db.syncMode == SyncAlways {
+		err = db.out.Sync()
+	}
+	db.metrics.ObserveWrite(len(batch), written, time.Since(start))
+	db.reportStorage()
+	req.res <- err
+	return
+}
+
+// writeEntry writes a single entry and returns the size of its record.
+func (db *Db) writeEntry(e entry) (int, error) {
+	packed := e
+	if err := db.codec.pack(&packed); err != nil {
+		return 0, err
+	}
+	encoded := packed.Encode()
 
 	f, err := os.Stat(db.params.out)
 	if err != nil {
-		db.writeHandler.Res <- err
-		return
+		return 0, err
 	}
 	if f.Size()+int64(len(encoded)) >= db.maxSize {
 		db.mtx.Lock()
@@ -236,43 +655,87 @@ func (db *Db) onWriteListener() (closed bool) {
 		db.mtx.Unlock()
 		newName := fmt.Sprintf("%d-segment", db.params.segmentCounter)
 		newPath := filepath.Join(db.params.container, newName)
+		// sealed segments are never written again, so they are synced
+		// whatever the sync mode is
+		if err := db.out.Sync(); err != nil {
+			return 0, err
+		}
 		if err := db.out.Close(); err != nil {
-			db.writeHandler.Res <- err
-			return
+			return 0, err
 		}
-		if err := os.Rename(db.params.out, newPath); err != nil {
-			db.writeHandler.Res <- err
-			return
+		// readers open the files under the lock, so the output file is
+		// replaced along with its index
+		if err := db.rotate(newPath); err != nil {
+			return 0, err
 		}
-		if file, err := os.Create(db.params.out); err != nil {
-			db.writeHandler.Res <- err
-			return
-		} else {
-			db.mtx.Lock()
-			db.out = file
-			db.outOffset = 0
-			db.params.index[newPath] = db.params.index[db.params.out]
-			db.params.index[db.params.out] = make(hashIndex)
-			db.mtx.Unlock()
+		if db.params.diskIndex {
+			if err := db.params.seal(newPath, &db.mtx); err != nil {
+				return 0, err
+			}
 		}
 	}
 	putErr := error(nil)
-	if db.params.segmentCounter > 1 {
+	if db.shouldMerge() {
 		db.mergeHandler.Req <- true
-		putErr = db.writeHash(e.key, encoded)
+		putErr = db.writeHash(e, encoded)
 		<-db.mergeHandler.Res
 	} else {
-		putErr = db.writeHash(e.key, encoded)
+		putErr = db.writeHash(e, encoded)
 	}
-	db.writeHandler.Res <- putErr
-	return
+	if putErr == nil && e.flags&flagDropBucket != 0 {
+		// the merge is finished at this point, so the sealed indices are
+		// safe to modify
+		db.mtx.Lock()
+		db.params.dropBucket(db.params.out, e.bucket)
+		db.mtx.Unlock()
+	}
+	if putErr != nil {
+		return 0, putErr
+	}
+	return len(encoded), nil
+}
+
+// rotate turns the output file into the sealed segment at newPath and
+// starts a new empty output file.
+func (db *Db) rotate(newPath string) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if err := os.Rename(db.params.out, newPath); err != nil {
+		return err
+	}
+	file, err := os.Create(db.params.out)
+	if err != nil {
+		return err
+	}
+	db.out = file
+	db.params.sealedSize += db.outOffset
+	db.outOffset = 0
+	db.params.index[newPath] = db.params.index[db.params.out]
+	db.params.index[db.params.out] = make(hashIndex)
+	db.params.drops[newPath] = db.params.drops[db.params.out]
+	delete(db.params.drops, db.params.out)
+	return nil
 }
 
-func (db *Db) writeHash(key string, encoded []byte) error {
+// shouldMerge tells whether enough segments are sealed to merge them.
+func (db *Db) shouldMerge() bool {
+	return db.mergeThreshold > 0 && db.params.segmentCounter >= db.mergeThreshold
+}
+
+// writeHash appends the encoded form of the plain entry to the current
+// file and indexes it.
+func (db *Db) writeHash(e entry, encoded []byte) error {
 	n, err := db.out.Write(encoded)
 	if err == nil {
 		db.mtx.Lock()
-		db.params.index[db.params.out][key] = db.outOffset
+		if e.flags&flagDropBucket == 0 {
+			db.params.current()[recordKey{e.bucket, e.key}] = position{
+				offset:  db.outOffset,
+				size:    int64(n),
+				rawSize: int64(e.size()),
+				deleted: e.flags&flagTombstone != 0,
+			}
+		}
 		db.outOffset += int64(n)
 		db.mtx.Unlock()
 	}
@@ -1,9 +1,15 @@
 package datastore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 // segment size for 6 records
@@ -112,12 +118,12 @@ func Test_Db_Segments(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(list) != 2 {
+	if len(list) != 4 {
 		t.Errorf("Invalid recovery")
 	}
 	containerName := filepath.Base(db.params.container)
 	for _, name := range list {
-		if name != containerName && name != outFileName {
+		if name != containerName && name != outFileName && name != lockFileName && name != currentFileName {
 			t.Errorf("Invalid out file name")
 		}
 	}
@@ -251,9 +257,381 @@ func Test_Db_Hash(t *testing.T) {
 		value: value1,
 		sum:	 getHashSum(key1, value1 + "_test"),
 	}
-	db.writeHash(e.key, e.Encode())
+	db.writeHash(e, e.Encode())
 	if _, err := db.Get(key1); err != ErrHashSums {
 		t.Log(err)
 		t.Errorf("Unexpected hash sum behaviour")
 	}
 }
+
+func TestDb_Context(t *testing.T) {
+	db := newTestDb(t, "test-context-db")
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := db.PutContext(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.GetContext(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Unexpected result %q, %v", value, err)
+	}
+
+	cancel()
+	if _, err := db.GetContext(ctx, "key"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled on get, got %v", err)
+	}
+	if err := db.Bucket("b").PutContext(ctx, "key", "value"); err != context.Canceled {
+		t.Errorf("Expected context.Canceled on put, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed on put, got %v", err)
+	}
+	if _, err := db.Get("key"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed on get, got %v", err)
+	}
+}
+
+func TestDb_ConcurrentClose(t *testing.T) {
+	db := newTestDb(t, "test-close-db")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := fmt.Sprintf("key%d-%d", i, j)
+				if err := db.Put(key, "value"); err == ErrClosed {
+					return
+				} else if err != nil {
+					t.Errorf("Unexpected put error %v", err)
+					return
+				}
+				if _, err := db.Get(key); err != nil && err != ErrClosed {
+					t.Errorf("Unexpected get error %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := db.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed on second close, got %v", err)
+	}
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-lock-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, testSizeBytes); err != ErrLocked {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+
+	ro, err := NewDb(dir, testSizeBytes, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := ro.Get("key"); err != nil || value != "value" {
+		t.Errorf("Unexpected read-only result %q, %v", value, err)
+	}
+	if err := ro.Put("key", "other"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, testSizeBytes)
+	if err != nil {
+		t.Fatalf("Cannot reopen the database after close: %v", err)
+	}
+	db.Close()
+}
+
+func TestDb_FailedOpen(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-failed-open-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a record cut in the middle fails the recovery
+	out := filepath.Join(dir, outFileName)
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(out, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := NewDb(dir, testSizeBytes); err == nil || err == ErrLocked {
+			t.Errorf("Expected a recovery error, got %v", err)
+		}
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		t.Fatalf("Failed open keeps the directory locked: %v", err)
+	}
+	unlockDir(lock)
+}
+
+func TestDb_InterruptedMerge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-interrupted-merge-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for key := range testValues {
+			if err := db.Put(key, fmt.Sprint(key, "-", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	container := filepath.Base(db.params.container)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a merge stopped before writing CURRENT leaves a container with
+	// a partial segment, names on both sides of the real one are tried
+	for _, name := range []string{containerName + "0", containerName + "zzzz"} {
+		partial := filepath.Join(dir, name)
+		if err := os.Mkdir(partial, 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(partial, "1-segment"), []byte{1, 2, 3}, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, testSizeBytes/2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := filepath.Base(db.params.container); got != container {
+			t.Errorf("Opened container %s instead of %s", got, container)
+		}
+		for key := range testValues {
+			if value, err := db.Get(key); err != nil || value != key+"-2" {
+				t.Errorf("Unexpected value of %s: %q, %v", key, value, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Errorf("Partial container %s is not removed: %v", name, err)
+		}
+	}
+
+	// without CURRENT the live container can't be told apart
+	if err := os.Remove(filepath.Join(dir, currentFileName)); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, containerName+"0")
+	if err := os.Mkdir(partial, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, testSizeBytes/2); err == nil {
+		t.Error("Opened a directory with several containers and no CURRENT file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, container)); err != nil {
+		t.Errorf("Container is removed: %v", err)
+	}
+}
+
+func TestDb_OpenReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-read-only-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound in an empty directory, got %v", err)
+	}
+	db.Close()
+	if list, _ := listStorageEntries(dir); len(list) != 0 {
+		t.Errorf("Read-only open created files %v", list)
+	}
+
+	db, err = NewDb(dir, testSizeBytes/2, WithDiskIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		for key, value := range testValues {
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := listTree(t, dir)
+
+	ro, err := OpenReadOnly(dir, WithDiskIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range testValues {
+		if found, err := ro.Get(key); err != nil || found != value {
+			t.Errorf("Unexpected value of %s: %q, %v", key, found, err)
+		}
+	}
+	if n := len(dump(t, ro)); n != len(testValues) {
+		t.Errorf("Scanned %d records, expected %d", n, len(testValues))
+	}
+	if err := ro.Put("key1", "other"); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := listTree(t, dir); !reflect.DeepEqual(before, after) {
+		t.Errorf("Read-only open changed the directory:\n%v\n%v", before, after)
+	}
+}
+
+// listTree returns the sizes of all the files under the directory.
+func listTree(t *testing.T, dir string) map[string]int64 {
+	res := make(map[string]int64)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		res[path] = info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDb_SizeLimits(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-limits-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes, WithMaxKeySize(8), WithMaxValueSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("long-key-1", "value"); err != ErrKeyTooLarge {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := db.Put("key", "a value longer than 16"); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := NewDb(dir, testSizeBytes, WithMaxValueSize(8)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge on recovery, got %v", err)
+	}
+	if _, err := NewDb(dir, testSizeBytes, WithMaxKeySize(0)); err == nil {
+		t.Error("Zero key size limit is accepted")
+	}
+}
+
+func TestDb_MergeThreshold(t *testing.T) {
+	for _, threshold := range []int{0, 4} {
+		t.Run(fmt.Sprint(threshold), func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "test-merge-threshold-db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			opts := []Option{WithMergeThreshold(threshold), WithSyncMode(SyncAlways)}
+			db, err := NewDb(dir, testSizeBytes/2, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// every round fills a segment, so more than ten of them are
+			// sealed without merges
+			for i := 0; i < 12; i++ {
+				for key := range testValues {
+					if err := db.Put(key, fmt.Sprint(key, "-", i)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if segments := len(db.params.index) - 1; threshold > 0 && segments >= threshold {
+					t.Errorf("%d segments are not merged", segments)
+				}
+			}
+			// moves the latest values out of the current file
+			for i := 0; i < 3; i++ {
+				if err := db.Put(fmt.Sprint("filler", i), "value"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if threshold == 0 && len(db.params.index) < 11 {
+				t.Errorf("Segments are merged with merges disabled")
+			}
+			for i := 0; i < 2; i++ {
+				for key := range testValues {
+					if value, err := db.Get(key); err != nil || value != key+"-11" {
+						t.Errorf("Unexpected value of %s: %q, %v", key, value, err)
+					}
+				}
+				db.Close()
+				if db, err = NewDb(dir, testSizeBytes/2, opts...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+		})
+	}
+	if _, err := NewDb(os.TempDir(), testSizeBytes, WithMergeThreshold(1)); err == nil {
+		t.Error("Merge threshold 1 is accepted")
+	}
+}
@@ -0,0 +1,357 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Index files are written next to sealed segments when the disk index is
+// enabled. The layout is:
+//
+//	entries  sorted by bucket and key:
+//	         u16 bucket len | bucket | u32 key len | key |
+//	         i64 offset | i64 size | i64 raw size | u8 deleted
+//	drops    u16 bucket len | bucket, buckets dropped by the segment
+//	bloom    bloom filter of all the entries
+//	sparse   u16 bucket len | bucket | u32 key len | key | i64 block offset,
+//	         the first key of every block of entries
+//	footer   i64 drops offset | i64 bloom offset | i64 sparse offset
+const (
+	indexSuffix     = ".idx"
+	indexBlockSize  = 64
+	indexFooterSize = 24
+)
+
+type indexBlock struct {
+	first  recordKey
+	offset int64
+}
+
+// diskIndex keeps a bloom filter and the first key of every block of the
+// index file in memory, the rest is read from disk on demand.
+type diskIndex struct {
+	droppedBuckets
+	path   string
+	filter *bloomFilter
+	blocks []indexBlock
+	end    int64
+	drops  []string
+}
+
+// droppedBuckets tracks the buckets dropped after the segment was sealed.
+type droppedBuckets struct {
+	mtx     sync.Mutex
+	dropped map[string]bool
+}
+
+func (d *droppedBuckets) isDropped(bucket string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.dropped[bucket]
+}
+
+func (d *droppedBuckets) dropBucket(bucket string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.dropped == nil {
+		d.dropped = make(map[string]bool)
+	}
+	d.dropped[bucket] = true
+}
+
+func appendBucket(buf []byte, bucket string) []byte {
+	var bl [2]byte
+	binary.LittleEndian.PutUint16(bl[:], uint16(len(bucket)))
+	buf = append(buf, bl[:]...)
+	return append(buf, bucket...)
+}
+
+func appendKey(buf []byte, key recordKey) []byte {
+	var kl [4]byte
+	binary.LittleEndian.PutUint32(kl[:], uint32(len(key.key)))
+	buf = appendBucket(buf, key.bucket)
+	buf = append(buf, kl[:]...)
+	return append(buf, key.key...)
+}
+
+func readKey(data []byte) (recordKey, []byte, error) {
+	var key recordKey
+	if len(data) < 2 {
+		return key, nil, fmt.Errorf("corrupted index")
+	}
+	bl := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+bl+4 {
+		return key, nil, fmt.Errorf("corrupted index")
+	}
+	key.bucket = string(data[2 : 2+bl])
+	data = data[2+bl:]
+	kl := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 4+kl {
+		return key, nil, fmt.Errorf("corrupted index")
+	}
+	key.key = string(data[4 : 4+kl])
+	return key, data[4+kl:], nil
+}
+
+func appendPosition(buf []byte, pos position) []byte {
+	var fixed [25]byte
+	binary.LittleEndian.PutUint64(fixed[:], uint64(pos.offset))
+	binary.LittleEndian.PutUint64(fixed[8:], uint64(pos.size))
+	binary.LittleEndian.PutUint64(fixed[16:], uint64(pos.rawSize))
+	if pos.deleted {
+		fixed[24] = 1
+	}
+	return append(buf, fixed[:]...)
+}
+
+func readPosition(data []byte) (position, []byte, error) {
+	if len(data) < 25 {
+		return position{}, nil, fmt.Errorf("corrupted index")
+	}
+	pos := position{
+		offset:  int64(binary.LittleEndian.Uint64(data)),
+		size:    int64(binary.LittleEndian.Uint64(data[8:])),
+		rawSize: int64(binary.LittleEndian.Uint64(data[16:])),
+		deleted: data[24] != 0,
+	}
+	return pos, data[25:], nil
+}
+
+func appendBlocks(buf []byte, blocks []indexBlock) []byte {
+	for _, block := range blocks {
+		buf = appendKey(buf, block.first)
+		var offset [8]byte
+		binary.LittleEndian.PutUint64(offset[:], uint64(block.offset))
+		buf = append(buf, offset[:]...)
+	}
+	return buf
+}
+
+func readBlocks(data []byte) ([]indexBlock, error) {
+	var (
+		blocks []indexBlock
+		err    error
+	)
+	for len(data) > 0 {
+		var block indexBlock
+		if block.first, data, err = readKey(data); err != nil {
+			return nil, err
+		}
+		if len(data) < 8 {
+			return nil, fmt.Errorf("corrupted index")
+		}
+		block.offset = int64(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// findBlock returns the number of the block which may hold the key or -1.
+func findBlock(blocks []indexBlock, key recordKey) int {
+	return sort.Search(len(blocks), func(i int) bool {
+		return key.less(blocks[i].first)
+	}) - 1
+}
+
+// writeDiskIndex stores the index of the segment and returns its in-memory
+// part. The file is replaced atomically, so a crash never leaves a partial
+// index behind.
+func writeDiskIndex(segmentPath string, index segmentIndex, drops []string) (*diskIndex, error) {
+	var keys []recordKey
+	positions := make(map[recordKey]position)
+	err := index.forEach(func(key recordKey, pos position) error {
+		keys = append(keys, key)
+		positions[key] = pos
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+
+	di := &diskIndex{
+		path:   segmentPath + indexSuffix,
+		filter: newBloomFilter(len(keys)),
+		drops:  drops,
+	}
+	var buf []byte
+	for i, key := range keys {
+		if i%indexBlockSize == 0 {
+			di.blocks = append(di.blocks, indexBlock{first: key, offset: int64(len(buf))})
+		}
+		di.filter.add(key)
+		buf = appendKey(buf, key)
+		buf = appendPosition(buf, positions[key])
+	}
+	di.end = int64(len(buf))
+	for _, bucket := range drops {
+		buf = appendBucket(buf, bucket)
+	}
+	bloomOffset := int64(len(buf))
+	buf = append(buf, di.filter.encode()...)
+	sparseOffset := int64(len(buf))
+	buf = appendBlocks(buf, di.blocks)
+	var footer [indexFooterSize]byte
+	binary.LittleEndian.PutUint64(footer[:], uint64(di.end))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(bloomOffset))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(sparseOffset))
+	buf = append(buf, footer[:]...)
+
+	tmpPath := di.path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, di.path); err != nil {
+		return nil, err
+	}
+	return di, nil
+}
+
+// loadDiskIndex reads the in-memory part of the index of the segment.
+func loadDiskIndex(segmentPath string) (*diskIndex, error) {
+	path := segmentPath + indexSuffix
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < indexFooterSize {
+		return nil, fmt.Errorf("corrupted index %s", path)
+	}
+	var footer [indexFooterSize]byte
+	if _, err := file.ReadAt(footer[:], info.Size()-indexFooterSize); err != nil {
+		return nil, err
+	}
+	end := int64(binary.LittleEndian.Uint64(footer[:]))
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	sparseOffset := int64(binary.LittleEndian.Uint64(footer[16:]))
+	if end < 0 || end > bloomOffset || bloomOffset > sparseOffset || sparseOffset > info.Size()-indexFooterSize {
+		return nil, fmt.Errorf("corrupted index %s", path)
+	}
+	tail := make([]byte, info.Size()-indexFooterSize-end)
+	if _, err := file.ReadAt(tail, end); err != nil {
+		return nil, err
+	}
+
+	di := &diskIndex{path: path, end: end}
+	for data := tail[:bloomOffset-end]; len(data) > 0; {
+		if len(data) < 2 || len(data) < 2+int(binary.LittleEndian.Uint16(data)) {
+			return nil, fmt.Errorf("corrupted index %s", path)
+		}
+		bl := int(binary.LittleEndian.Uint16(data))
+		di.drops = append(di.drops, string(data[2:2+bl]))
+		data = data[2+bl:]
+	}
+	if di.filter, err = decodeBloomFilter(tail[bloomOffset-end : sparseOffset-end]); err != nil {
+		return nil, err
+	}
+	if di.blocks, err = readBlocks(tail[sparseOffset-end:]); err != nil {
+		return nil, err
+	}
+	return di, nil
+}
+
+func (di *diskIndex) find(key recordKey) (position, bool, error) {
+	if di.isDropped(key.bucket) || !di.filter.mayContain(key) {
+		return position{}, false, nil
+	}
+	i := findBlock(di.blocks, key)
+	if i < 0 {
+		return position{}, false, nil
+	}
+	end := di.end
+	if i+1 < len(di.blocks) {
+		end = di.blocks[i+1].offset
+	}
+
+	file, err := os.Open(di.path)
+	if err != nil {
+		return position{}, false, err
+	}
+	defer file.Close()
+	block := make([]byte, end-di.blocks[i].offset)
+	if _, err := file.ReadAt(block, di.blocks[i].offset); err != nil {
+		return position{}, false, err
+	}
+	for data := block; len(data) > 0; {
+		var (
+			found recordKey
+			pos   position
+		)
+		if found, data, err = readKey(data); err != nil {
+			return position{}, false, err
+		}
+		if pos, data, err = readPosition(data); err != nil {
+			return position{}, false, err
+		}
+		if found == key {
+			return pos, true, nil
+		}
+	}
+	return position{}, false, nil
+}
+
+func (di *diskIndex) forEach(fn func(recordKey, position) error) error {
+	file, err := os.Open(di.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return di.forEachIn(file, fn)
+}
+
+func (di *diskIndex) snapshot() (indexSnapshot, error) {
+	file, err := os.Open(di.path)
+	if err != nil {
+		return indexSnapshot{}, err
+	}
+	return indexSnapshot{file: file, forEach: func(fn func(recordKey, position) error) error {
+		return di.forEachIn(file, fn)
+	}}, nil
+}
+
+// forEachIn reads the entries from the opened index file.
+func (di *diskIndex) forEachIn(file *os.File, fn func(recordKey, position) error) error {
+	in := bufio.NewReader(io.NewSectionReader(file, 0, di.end))
+	header := make([]byte, 6)
+	for {
+		var key recordKey
+		if _, err := io.ReadFull(in, header[:2]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		bucket := make([]byte, binary.LittleEndian.Uint16(header))
+		if _, err := io.ReadFull(in, bucket); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(in, header[2:]); err != nil {
+			return err
+		}
+		rest := make([]byte, int(binary.LittleEndian.Uint32(header[2:]))+25)
+		if _, err := io.ReadFull(in, rest); err != nil {
+			return err
+		}
+		key.bucket, key.key = string(bucket), string(rest[:len(rest)-25])
+		pos, _, err := readPosition(rest[len(rest)-25:])
+		if err != nil {
+			return err
+		}
+		if di.isDropped(key.bucket) {
+			continue
+		}
+		if err := fn(key, pos); err != nil {
+			return err
+		}
+	}
+}
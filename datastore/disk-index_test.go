@@ -0,0 +1,180 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		bf.add(recordKey{key: fmt.Sprintf("key%d", i)})
+	}
+	decoded, err := decodeBloomFilter(bf.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if !decoded.mayContain(recordKey{key: fmt.Sprintf("key%d", i)}) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if decoded.mayContain(recordKey{key: fmt.Sprintf("missing%d", i)}) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("Too many false positives: %d", falsePositives)
+	}
+	if bf.mayContain(recordKey{bucket: "other", key: "key1"}) && bf.mayContain(recordKey{bucket: "other", key: "key2"}) &&
+		bf.mayContain(recordKey{bucket: "other", key: "key3"}) {
+		t.Error("Buckets are not taken into account")
+	}
+}
+
+func TestDiskIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-disk-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash := make(hashIndex)
+	for i := 0; i < 3*indexBlockSize+5; i++ {
+		key := recordKey{bucket: fmt.Sprintf("b%d", i%3), key: fmt.Sprintf("key%d", i)}
+		hash[key] = position{offset: int64(i * 100), size: 100, rawSize: 120, deleted: i%10 == 0}
+	}
+	segmentPath := filepath.Join(dir, "1-segment")
+	if _, err := writeDiskIndex(segmentPath, hash, []string{"dropped"}); err != nil {
+		t.Fatal(err)
+	}
+	di, err := loadDiskIndex(segmentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(di.blocks) != 4 || len(di.drops) != 1 || di.drops[0] != "dropped" {
+		t.Errorf("Unexpected index %d blocks, drops %v", len(di.blocks), di.drops)
+	}
+
+	for key, expected := range hash {
+		if pos, ok, err := di.find(key); err != nil || !ok || pos != expected {
+			t.Errorf("Bad position of %v: %+v %t %v", key, pos, ok, err)
+		}
+	}
+	for _, key := range []recordKey{{key: "key1"}, {bucket: "b1", key: "missing"}, {bucket: "zzz", key: "key1"}} {
+		if _, ok, err := di.find(key); err != nil || ok {
+			t.Errorf("Unexpected key %v found (%v)", key, err)
+		}
+	}
+
+	count := 0
+	err = di.forEach(func(key recordKey, pos position) error {
+		if hash[key] != pos {
+			t.Errorf("Bad position of %v: %+v", key, pos)
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != len(hash) {
+		t.Errorf("Iterated over %d keys of %d (%v)", count, len(hash), err)
+	}
+
+	di.dropBucket("b1")
+	if _, ok, _ := di.find(recordKey{bucket: "b1", key: "key1"}); ok {
+		t.Error("Dropped bucket key is found")
+	}
+}
+
+func TestDb_DiskIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-disk-index-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSizeBytes, WithDiskIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	values := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		key, value := fmt.Sprintf("key%d", i%20), fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		values[key] = value
+	}
+	bucket := db.Bucket("bucket")
+	if err := bucket.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	delete(values, "key0")
+	// move the bucket records into sealed segments
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("filler%d", i), "filler"); err != nil {
+			t.Fatal(err)
+		}
+		values[fmt.Sprintf("filler%d", i)] = "filler"
+	}
+
+	check := func(t *testing.T) {
+		sealed := 0
+		for fileName, index := range db.params.index {
+			if _, ok := index.(*diskIndex); ok {
+				sealed++
+			} else if fileName != db.params.out {
+				t.Errorf("Segment %s keeps the whole index in memory", fileName)
+			}
+		}
+		if sealed == 0 {
+			t.Error("No sealed segments")
+		}
+		for key, value := range values {
+			if found, err := db.Get(key); err != nil || found != value {
+				t.Errorf("Cannot get %s: %s, %v", key, found, err)
+			}
+		}
+		if _, err := db.Get("key0"); err != ErrNotFound {
+			t.Errorf("Deleted key is found: %v", err)
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Missing key is found: %v", err)
+		}
+	}
+	t.Run("sealed segments", check)
+
+	if found, err := bucket.Get("key"); err != nil || found != "value" {
+		t.Errorf("Cannot get bucket key: %v", err)
+	}
+	if err := bucket.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Get("key"); err != ErrNotFound {
+		t.Errorf("Dropped key is found: %v", err)
+	}
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDb(dir, testSizeBytes, WithDiskIndex()); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if _, err := db.Bucket("bucket").Get("key"); err != ErrNotFound {
+			t.Errorf("Dropped key is recovered: %v", err)
+		}
+		if keys := mustStats(t, db).Total.Keys; keys != len(values) {
+			t.Errorf("Unexpected keys count %d, expected %d", keys, len(values))
+		}
+	})
+}
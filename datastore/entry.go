@@ -3,86 +3,170 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// extendedHeader is set in the key length field of records which carry
+	// flags and a bucket name. Records of the default bucket without flags
+	// keep the original layout, so old segments are read as is.
+	extendedHeader = 1 << 31
+
+	flagTombstone  = 1 << 0
+	flagDropBucket = 1 << 1
+	flagCompressed = 1 << 2
+	flagEncrypted  = 1 << 3
+	flagExpires    = 1 << 4
 )
 
 type entry struct {
-	key, value string
-	sum [20]byte
+	bucket, key, value string
+	flags              uint8
+	// keyID identifies the encryption key of encrypted records.
+	keyID uint32
+	// expires is the expiration time of the record in Unix milliseconds,
+	// it is stored only with flagExpires.
+	expires int64
+	sum     [20]byte
 }
 
+// expired tells whether the record has expired by the time.
+func (e *entry) expired(now time.Time) bool {
+	return e.flags&flagExpires != 0 && e.expires <= now.UnixNano()/int64(time.Millisecond)
+}
+
+func (e *entry) extended() bool {
+	return e.bucket != "" || e.flags != 0
+}
+
+// extSize returns the length of the extended header.
+func (e *entry) extSize() int {
+	if !e.extended() {
+		return 0
+	}
+	size := 3 + len(e.bucket)
+	if e.flags&flagEncrypted != 0 {
+		size += 4
+	}
+	if e.flags&flagExpires != 0 {
+		size += 8
+	}
+	return size
+}
+
+// size returns the length of the encoded record.
+func (e *entry) size() int {
+	return len(e.key) + len(e.value) + 12 + 20 + e.extSize()
+}
 
 func (e *entry) Encode() []byte {
 	header := 12
-	sumSize := 20
+	ext := e.extSize()
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + header + sumSize
+	size := e.size()
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl + header:], e.value)
-	copy(res[kl + header + vl:], e.sum[:])
+	if e.extended() {
+		binary.LittleEndian.PutUint32(res[4:], uint32(kl)|extendedHeader)
+		res[8] = e.flags
+		binary.LittleEndian.PutUint16(res[9:], uint16(len(e.bucket)))
+		copy(res[11:], e.bucket)
+		ext := res[11+len(e.bucket):]
+		if e.flags&flagEncrypted != 0 {
+			binary.LittleEndian.PutUint32(ext, e.keyID)
+			ext = ext[4:]
+		}
+		if e.flags&flagExpires != 0 {
+			binary.LittleEndian.PutUint64(ext, uint64(e.expires))
+		}
+	} else {
+		binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	}
+	copy(res[ext+8:], e.key)
+	binary.LittleEndian.PutUint32(res[ext+kl+8:], uint32(vl))
+	copy(res[ext+kl+header:], e.value)
+	copy(res[ext+kl+header+vl:], e.sum[:])
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+// Decode fills the entry from the encoded record. It returns ErrCorrupted
+// if the lengths stored in the record don't match its size.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < 12+20 {
+		return ErrCorrupted
+	}
+	kl := uint64(binary.LittleEndian.Uint32(input[4:]))
+	body := input[8:]
+	e.bucket, e.flags, e.keyID, e.expires = "", 0, 0, 0
+	if kl&extendedHeader != 0 {
+		kl &^= extendedHeader
+		e.flags = body[0]
+		bl := uint64(binary.LittleEndian.Uint16(body[1:]))
+		if uint64(len(body)) < 3+bl+4+20 {
+			return ErrCorrupted
+		}
+		e.bucket = string(body[3 : 3+bl])
+		body = body[3+bl:]
+		if e.flags&flagEncrypted != 0 {
+			if len(body) < 4+4+20 {
+				return ErrCorrupted
+			}
+			e.keyID = binary.LittleEndian.Uint32(body)
+			body = body[4:]
+		}
+		if e.flags&flagExpires != 0 {
+			if len(body) < 8+4+20 {
+				return ErrCorrupted
+			}
+			e.expires = int64(binary.LittleEndian.Uint64(body))
+			body = body[8:]
+		}
+	}
+	if uint64(len(body)) < kl+4+20 {
+		return ErrCorrupted
+	}
+	vl := uint64(binary.LittleEndian.Uint32(body[kl:]))
+	if uint64(len(body)) != kl+4+vl+20 {
+		return ErrCorrupted
+	}
+
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
+	copy(keyBuf, body[:kl])
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl + 8:])
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl + 12:kl + 12 + vl])
+	copy(valBuf, body[kl+4:kl+4+vl])
 	e.value = string(valBuf)
 
 	var sumBuf [20]byte
-	copy(sumBuf[:], input[kl + vl + 12:kl + vl + 12 + 20])
+	copy(sumBuf[:], body[kl+vl+4:kl+vl+4+20])
 	e.sum = sumBuf
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, [20]byte, error) {
-	header, err := in.Peek(8)
-	var sumBuf [20]byte
-
-	if err != nil {
-		return "", sumBuf, err
-	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", sumBuf, err
-	}
-
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", sumBuf, err
-	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", sumBuf, err
-	}
-
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+// readEntry reads a whole record from the reader and returns it along
+// with the number of bytes it occupies on disk. Records longer than
+// maxSize are rejected before reading, so a corrupted size can't exhaust
+// memory.
+func readEntry(in *bufio.Reader, maxSize int) (entry, int, error) {
+	var e entry
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", sumBuf, err
+		return e, 0, err
 	}
-	if n != valSize {
-		return "", sumBuf, fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	size := uint64(binary.LittleEndian.Uint32(header))
+	if size > uint64(maxSize) {
+		return e, 0, ErrCorrupted
 	}
 
-	size, err := in.Read(sumBuf[:])
-	if err != nil {
-		return "", sumBuf, err
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return e, 0, err
 	}
-	if size != 20 {
-		return "", sumBuf, fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	if err := e.Decode(data); err != nil {
+		return e, 0, err
 	}
-
-	return string(data), sumBuf, nil
+	return e, int(size), nil
 }
@@ -3,7 +3,9 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"testing"
+	"time"
 )
 
 func TestEntry_Encode(t *testing.T) {
@@ -26,14 +28,67 @@ func TestReadValue(t *testing.T) {
 	e := entry{key: "key", value: "test-value"}
 	e.sum = getHashSum(e.key, e.value)
 	data := e.Encode()
-	v, hash, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	read, n, err := readEntry(bufio.NewReader(bytes.NewReader(data)), 1<<20)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if v != "test-value" {
-		t.Errorf("Got bat value [%s]", v)
+	if n != len(data) {
+		t.Errorf("Got bad size %d", n)
 	}
-	if err := compareHash(e.key, e.value, hash); err != nil {
+	if read.value != "test-value" {
+		t.Errorf("Got bat value [%s]", read.value)
+	}
+	if err := compareHash(e.key, e.value, read.sum); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEntry_EncodeBucket(t *testing.T) {
+	e := entry{bucket: "bucket", key: "key", value: "value", flags: flagTombstone}
+	e.sum = getHashSum(e.key, e.value)
+	var decoded entry
+	decoded.Decode(e.Encode())
+	if decoded != e {
+		t.Errorf("Bad decoded entry %+v", decoded)
+	}
+
+	plain := entry{key: "key", value: "value"}
+	if len(plain.Encode()) != 12+20+len("key")+len("value") {
+		t.Error("default bucket records must keep the original layout")
+	}
+}
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	e := entry{bucket: "bucket", key: "key", value: "value", flags: flagEncrypted}
+	data := e.Encode()
+	for i := 0; i < len(data); i++ {
+		var decoded entry
+		if err := decoded.Decode(data[:i]); err != ErrCorrupted {
+			t.Errorf("Expected ErrCorrupted for %d bytes, got %v", i, err)
+		}
+	}
+	binary.LittleEndian.PutUint32(data[4:], 1<<30|extendedHeader)
+	var decoded entry
+	if err := decoded.Decode(data); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted for a bad key length, got %v", err)
+	}
+
+	binary.LittleEndian.PutUint32(data, 1<<31)
+	if _, _, err := readEntry(bufio.NewReader(bytes.NewReader(data)), 1<<20); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted for a huge record, got %v", err)
+	}
+}
+
+func TestEntry_EncodeExpires(t *testing.T) {
+	e := entry{key: "key", value: "value", flags: flagExpires | flagEncrypted, keyID: 3, expires: 1234}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
 		t.Fatal(err)
 	}
+	if decoded != e {
+		t.Errorf("Bad decoded entry %+v", decoded)
+	}
+	if !e.expired(time.Unix(2, 0)) || e.expired(time.Unix(1, 0)) {
+		t.Error("Wrong expiration check")
+	}
 }
@@ -1,17 +1,51 @@
 package datastore
 
-import "fmt"
+import (
+	"fmt"
+	"path/filepath"
+)
 
 const (
-	outFileName = "current-data"
+	outFileName   = "current-data"
+	lockFileName  = "LOCK"
 	containerName = "container"
-	MaxFileSizeMb = 10
+	// currentFileName holds the name of the container with the live
+	// segments, merges replace it once the new container is complete
+	currentFileName = "CURRENT"
+	MaxFileSizeMb   = 10
 )
 
-type hashIndex map[string]int64
-type indexes map[string]hashIndex
+func lockPath(dir string) string {
+	return filepath.Join(dir, lockFileName)
+}
+
+type recordKey struct {
+	bucket, key string
+}
+
+type position struct {
+	offset int64
+	// size is the length of the record on disk, rawSize is the length it
+	// would take without compression.
+	size, rawSize int64
+	deleted       bool
+}
+
+type hashIndex map[recordKey]position
+type indexes map[string]segmentIndex
 
 var (
-	ErrNotFound = fmt.Errorf("record does not exist")
-	ErrHashSums = fmt.Errorf("hash sums don't match")
+	ErrNotFound      = fmt.Errorf("record does not exist")
+	ErrHashSums      = fmt.Errorf("hash sums don't match")
+	ErrInvalidBucket = fmt.Errorf("invalid bucket name")
+	ErrUnknownKey    = fmt.Errorf("unknown encryption key")
+	ErrClosed        = fmt.Errorf("database is closed")
+	ErrLocked        = fmt.Errorf("database is used by another process")
+	ErrReadOnly      = fmt.Errorf("database is opened read-only")
+	ErrKeyTooLarge   = fmt.Errorf("key is too large")
+	ErrValueTooLarge = fmt.Errorf("value is too large")
+	ErrCorrupted     = fmt.Errorf("corrupted record")
+	// ErrMalformedImport is returned by Import for input which is not an
+	// export.
+	ErrMalformedImport = fmt.Errorf("malformed import")
 )
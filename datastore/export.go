@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Format is the encoding of exported records.
+type Format int
+
+const (
+	// FormatJSONLines writes a JSON object per line:
+	//
+	//	{"bucket":"name","key":"key","value":"value"}
+	//
+	// The bucket field is omitted for the default bucket. JSON strings hold
+	// only UTF-8 text, so records with other bytes have all the fields
+	// encoded in base64 and "encoding":"base64" set.
+	FormatJSONLines Format = iota
+	// FormatBinary writes the exportMagic header followed by records of
+	//
+	//	u16 bucket len | bucket | u32 key len | key | u32 value len | value
+	//
+	// All the numbers are little endian.
+	FormatBinary
+)
+
+const (
+	exportMagic     = "RZDBEXP1"
+	importBatchSize = 256
+
+	encodingBase64 = "base64"
+)
+
+type exportRecord struct {
+	Bucket   string `json:"bucket,omitempty"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newExportRecord(bucket, key, value string) exportRecord {
+	if utf8.ValidString(bucket) && utf8.ValidString(key) && utf8.ValidString(value) {
+		return exportRecord{Bucket: bucket, Key: key, Value: value}
+	}
+	enc := base64.StdEncoding
+	return exportRecord{
+		Bucket:   enc.EncodeToString([]byte(bucket)),
+		Key:      enc.EncodeToString([]byte(key)),
+		Value:    enc.EncodeToString([]byte(value)),
+		Encoding: encodingBase64,
+	}
+}
+
+func (r exportRecord) entry() (entry, error) {
+	switch r.Encoding {
+	case "":
+		return entry{bucket: r.Bucket, key: r.Key, value: r.Value}, nil
+	case encodingBase64:
+		var fields [3][]byte
+		for i, field := range []string{r.Bucket, r.Key, r.Value} {
+			var err error
+			if fields[i], err = base64.StdEncoding.DecodeString(field); err != nil {
+				return entry{}, err
+			}
+		}
+		return entry{bucket: string(fields[0]), key: string(fields[1]), value: string(fields[2])}, nil
+	default:
+		return entry{}, fmt.Errorf("unknown encoding %q", r.Encoding)
+	}
+}
+
+// Export writes all the live records to w.
+func (db *Db) Export(w io.Writer, format Format) error {
+	out := bufio.NewWriter(w)
+	var write func(bucket, key, value string) error
+	switch format {
+	case FormatJSONLines:
+		enc := json.NewEncoder(out)
+		write = func(bucket, key, value string) error {
+			return enc.Encode(newExportRecord(bucket, key, value))
+		}
+	case FormatBinary:
+		if _, err := out.WriteString(exportMagic); err != nil {
+			return err
+		}
+		write = func(bucket, key, value string) error {
+			var lens [4]byte
+			binary.LittleEndian.PutUint16(lens[:], uint16(len(bucket)))
+			out.Write(lens[:2])
+			out.WriteString(bucket)
+			binary.LittleEndian.PutUint32(lens[:], uint32(len(key)))
+			out.Write(lens[:])
+			out.WriteString(key)
+			binary.LittleEndian.PutUint32(lens[:], uint32(len(value)))
+			out.Write(lens[:])
+			_, err := out.WriteString(value)
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown export format %d", format)
+	}
+	if err := db.Scan(write); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Import reads records written by Export in any of the formats and puts
+// them into the database in batches. It returns the number of imported
+// records, which are kept even if a later record fails. Input which can't
+// be read as records fails with ErrMalformedImport.
+func (db *Db) Import(r io.Reader) (int, error) {
+	in := bufio.NewReader(r)
+	var next func() (entry, error)
+	if magic, err := in.Peek(len(exportMagic)); err == nil && bytes.Equal(magic, []byte(exportMagic)) {
+		in.Discard(len(exportMagic))
+		next = func() (entry, error) {
+			return db.readExported(in)
+		}
+	} else {
+		dec := json.NewDecoder(in)
+		next = func() (entry, error) {
+			var record exportRecord
+			if err := dec.Decode(&record); err != nil {
+				return entry{}, err
+			}
+			return record.entry()
+		}
+	}
+
+	imported := 0
+	batch := make([]entry, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.writeBatch(context.Background(), batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		e, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return imported, flushErr
+			}
+			if err == ErrKeyTooLarge || err == ErrValueTooLarge {
+				return imported, fmt.Errorf("record %d: %w", imported+1, err)
+			}
+			return imported, fmt.Errorf("%w: record %d: %s", ErrMalformedImport, imported+1, err)
+		}
+		if batch = append(batch, e); len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+func (db *Db) readExported(in *bufio.Reader) (entry, error) {
+	var (
+		e    entry
+		lens [4]byte
+	)
+	if _, err := io.ReadFull(in, lens[:2]); err != nil {
+		return e, err
+	}
+	bucket := make([]byte, binary.LittleEndian.Uint16(lens[:]))
+	fields := [][]byte{bucket, nil, nil}
+	for i := range fields {
+		if i > 0 {
+			if _, err := io.ReadFull(in, lens[:]); err != nil {
+				return e, unexpectedEOF(err)
+			}
+			n := int64(binary.LittleEndian.Uint32(lens[:]))
+			if i == 1 && n > int64(db.codec.maxKeySize) {
+				return e, ErrKeyTooLarge
+			} else if i == 2 && n > int64(db.codec.maxValueSize) {
+				return e, ErrValueTooLarge
+			}
+			fields[i] = make([]byte, n)
+		}
+		if _, err := io.ReadFull(in, fields[i]); err != nil {
+			return e, unexpectedEOF(err)
+		}
+	}
+	e.bucket, e.key, e.value = string(fields[0]), string(fields[1]), string(fields[2])
+	return e, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
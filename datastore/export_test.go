@@ -0,0 +1,218 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestDb(t *testing.T, name string, opts ...Option) *Db {
+	dir, err := os.MkdirTemp("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := NewDb(dir, testSizeBytes, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func dump(t *testing.T, db *Db) map[string]string {
+	res := make(map[string]string)
+	err := db.Scan(func(bucket, key, value string) error {
+		res[bucket+"/"+key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDb_Scan(t *testing.T) {
+	db := newTestDb(t, "test-scan-db")
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Bucket("b").Put(fmt.Sprintf("b%d", i%3), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := dump(t, db)
+	if len(data) != 12 || data["/key9"] != "value9" || data["b/b0"] != "value9" {
+		t.Errorf("Unexpected scan result %v", data)
+	}
+	if _, ok := data["/key3"]; ok {
+		t.Error("Deleted key is scanned")
+	}
+
+	var keys []string
+	err := db.Bucket("b").Scan("b", func(key, value string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(keys, []string{"b0", "b1", "b2"}) {
+		t.Errorf("Unexpected bucket scan %v (%v)", keys, err)
+	}
+}
+
+func TestBucket_ScanPage(t *testing.T) {
+	db := newTestDb(t, "test-scan-page-db")
+	b := db.Bucket("b")
+	for i := 0; i < 10; i++ {
+		if err := b.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("key4"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		pages    [][]string
+		after    string
+		hasAfter bool
+	)
+	for {
+		var page []string
+		last, more, err := b.ScanPage(after, hasAfter, 3, func(key, value string) error {
+			page = append(page, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page)
+		if !more {
+			break
+		}
+		// keys written before the cursor are not returned
+		if err := b.Put("a", "value"); err != nil {
+			t.Fatal(err)
+		}
+		after, hasAfter = last, true
+	}
+	// the deleted key takes a place in its page
+	expected := [][]string{{"key0", "key1", "key2"}, {"key3", "key5"}, {"key6", "key7", "key8"}, {"key9"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Unexpected pages %v", pages)
+	}
+
+	// the newest records win over the ones of the older segments
+	dir, err := os.MkdirTemp("", "test-scan-page-segments-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err = NewDb(dir, testSizeBytes/2, WithMergeThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		for key := range testValues {
+			if err := db.Put(key, fmt.Sprint(key, "-", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scanned := make(map[string]string)
+	after, hasAfter = "", false
+	for more := true; more; hasAfter = true {
+		after, more, err = db.Bucket("").ScanPage(after, hasAfter, 1, func(key, value string) error {
+			scanned[key] = value
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(scanned) != len(testValues) || scanned["key1"] != "key1-3" || scanned["key3"] != "key3-3" {
+		t.Errorf("Unexpected scan of the segments %v", scanned)
+	}
+}
+
+func TestDb_ExportImport(t *testing.T) {
+	src := newTestDb(t, "test-export-db")
+	for i := 0; i < 20; i++ {
+		bucket := []string{"", "users", "teams"}[i%3]
+		value := fmt.Sprintf("value %d\n\"quoted\"", i)
+		if err := src.Bucket(bucket).Put(fmt.Sprintf("key%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Bucket("users").Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	// bytes which are not UTF-8 must survive the JSON export
+	binary := []struct{ bucket, key, value string }{
+		{"", "bin", "\xff\x00\xc3\x28 value"},
+		{"users", "\xfe\xff", "text"},
+		{"teams", "utf8", "значення ✓"},
+	}
+	for _, r := range binary {
+		if err := src.Bucket(r.bucket).Put(r.key, r.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := dump(t, src)
+
+	for _, format := range []Format{FormatJSONLines, FormatBinary} {
+		t.Run(fmt.Sprint(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := src.Export(&buf, format); err != nil {
+				t.Fatal(err)
+			}
+			if format == FormatJSONLines && strings.Count(buf.String(), "\n") != len(expected) {
+				t.Errorf("Expected a line per record:\n%s", buf.String())
+			}
+
+			dst := newTestDb(t, "test-import-db")
+			n, err := dst.Import(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(expected) {
+				t.Errorf("Imported %d records, expected %d", n, len(expected))
+			}
+			if imported := dump(t, dst); !reflect.DeepEqual(imported, expected) {
+				t.Errorf("Unexpected imported data %v", imported)
+			}
+		})
+	}
+
+	t.Run("bad input", func(t *testing.T) {
+		dst := newTestDb(t, "test-import-bad-db")
+		input := `{"key":"a","value":"1"}` + "\n" + `{"key":` + "\n"
+		n, err := dst.Import(strings.NewReader(input))
+		if !errors.Is(err, ErrMalformedImport) || n != 1 {
+			t.Errorf("Unexpected import result %d, %v", n, err)
+		}
+		if _, err := dst.Import(strings.NewReader(exportMagic + "\x00\x00\x01")); !errors.Is(err, ErrMalformedImport) {
+			t.Errorf("Truncated binary input is accepted: %v", err)
+		}
+		for _, input := range []string{
+			`{"key":"a","value":"!!!","encoding":"base64"}`,
+			`{"key":"a","value":"1","encoding":"hex"}`,
+		} {
+			if _, err := dst.Import(strings.NewReader(input)); !errors.Is(err, ErrMalformedImport) {
+				t.Errorf("Unexpected %s import result %v", input, err)
+			}
+		}
+	})
+}
@@ -3,17 +3,21 @@ package datastore
 import (
 	"bufio"
 	"os"
+	"path/filepath"
 	"sort"
 	"fmt"
+	"strconv"
+	"strings"
 	"crypto/sha1"
 )
 
-func searchValue(file *os.File, position int64) (string, [20]byte, error) {
-		if _, err := file.Seek(position, 0); err != nil {
-			return "", [20]byte{},  err
-		}
-		reader := bufio.NewReader(file)
-		return readValue(reader)
+func searchEntry(file *os.File, offset int64, maxSize int) (entry, error) {
+	if _, err := file.Seek(offset, 0); err != nil {
+		return entry{}, err
+	}
+	reader := bufio.NewReader(file)
+	e, _, err := readEntry(reader, maxSize)
+	return e, err
 }
 
 func getSortedKeys(index indexes) []string {
@@ -21,10 +25,34 @@ func getSortedKeys(index indexes) []string {
 	for key := range index {
 		keys = append(keys, key)
 	}
-	sort.Strings(keys)
+	sortFiles(keys)
 	return keys
 }
 
+// sortFiles orders the data files from the oldest to the newest: segments
+// by their numbers followed by the output file.
+func sortFiles(files []string) {
+	sort.Slice(files, func(i, j int) bool {
+		ni, iok := segmentNumber(files[i])
+		nj, jok := segmentNumber(files[j])
+		if iok && jok {
+			return ni < nj
+		} else if iok != jok {
+			return iok
+		}
+		return files[i] < files[j]
+	})
+}
+
+func segmentNumber(path string) (int, bool) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, "-segment") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(name, "-segment"))
+	return n, err == nil
+}
+
 func listStorageEntries(dir string) ([]string, error) {
 	file, err := os.Open(dir)
   if err != nil {
@@ -34,6 +62,22 @@ func listStorageEntries(dir string) ([]string, error) {
   return file.Readdirnames(0)
 }
 
+// listSegments returns the sorted names of the segment files in the container.
+func listSegments(container string) ([]string, error) {
+	list, err := listStorageEntries(container)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]string, 0, len(list))
+	for _, name := range list {
+		if strings.HasSuffix(name, "-segment") {
+			segments = append(segments, name)
+		}
+	}
+	sortFiles(segments)
+	return segments, nil
+}
+
 func getHashSum(key string, value string) [20]byte {
 	return sha1.Sum([]byte(key + " " + value))
 }
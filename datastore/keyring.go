@@ -0,0 +1,53 @@
+package datastore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Keyring holds AES keys by their ids. New records are encrypted with the
+// Current key, the rest of the keys are needed to read older records until
+// a merge re-encrypts them.
+type Keyring struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+// ParseKeyring reads keys in the "id:hex-key" form separated by commas or
+// new lines. Empty lines and lines starting with # are skipped. The key with
+// the greatest id becomes the current one, so keys are rotated by adding
+// a new key with a greater id.
+func ParseKeyring(s string) (Keyring, error) {
+	keyring := Keyring{Keys: make(map[uint32][]byte)}
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return keyring, fmt.Errorf("bad key format, expected id:hex-key")
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return keyring, fmt.Errorf("bad key id %q: %s", parts[0], err)
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return keyring, fmt.Errorf("bad key %d: %s", id, err)
+		}
+		if _, ok := keyring.Keys[uint32(id)]; ok {
+			return keyring, fmt.Errorf("duplicate key id %d", id)
+		}
+		keyring.Keys[uint32(id)] = key
+		if len(keyring.Keys) == 1 || uint32(id) > keyring.Current {
+			keyring.Current = uint32(id)
+		}
+	}
+	return keyring, nil
+}
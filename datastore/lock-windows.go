@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package datastore
+
+import "os"
+
+// lockDir only creates the LOCK file, flock is not available on Windows.
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(lockPath(dir), os.O_RDWR|os.O_CREATE, 0o600)
+}
+
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
@@ -5,15 +5,19 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
-func NewMergeHandler(storageParams *storageEntries, mtx *sync.Mutex) *MergeHandler {
+func NewMergeHandler(storageParams *storageEntries, codec *recordCodec, metrics Metrics, mtx *sync.Mutex) *MergeHandler {
 	return &MergeHandler{
 		Req:           make(chan bool),
 		Res:           make(chan error),
 		closed:        make(chan bool),
 		storageParams: storageParams,
+		codec:         codec,
+		metrics:       metrics,
 		mtx:           mtx,
 	}
 }
@@ -22,6 +26,8 @@ type MergeHandler struct {
 	Req           chan bool
 	Res           chan error
 	storageParams *storageEntries
+	codec         *recordCodec
+	metrics       Metrics
 	mtx           *sync.Mutex
 	closed        chan bool
 }
@@ -50,14 +56,27 @@ func (mh *MergeHandler) merge() (closed bool) {
 		closed = true
 		return
 	}
+	start := time.Now()
+	err := mh.execMerge()
+	mh.metrics.ObserveMerge(time.Since(start), err)
+	mh.Res <- err
+	return
+}
+
+func (mh *MergeHandler) execMerge() error {
 	keys := getSortedKeys(mh.storageParams.index)
 
 	dir := filepath.Dir(mh.storageParams.out)
 	container, err := ioutil.TempDir(dir, containerName)
 	if err != nil {
-		mh.Res <- err
-		return
+		return err
 	}
+	complete := false
+	defer func() {
+		if !complete {
+			os.RemoveAll(container)
+		}
+	}()
 
 	mh.mtx.Lock()
 	mh.storageParams.segmentCounter = 1
@@ -66,72 +85,125 @@ func (mh *MergeHandler) merge() (closed bool) {
 	segmentPath := filepath.Join(container, segmentName)
 	segment, err := os.Create(segmentPath)
 	if err != nil {
-		mh.Res <- err
-		return
+		return err
 	}
 	defer segment.Close()
 
-	var segmentOffset int64
-	segmentHash := make(hashIndex)
+	// the newest record of every key wins
+	type source struct {
+		fileName string
+		pos      position
+	}
+	sources := make(map[recordKey]source)
 	for i := len(keys) - 1; i >= 0; i-- {
 		fileName := keys[i]
 		if fileName == mh.storageParams.out {
 			continue
 		}
-		mergable, err := os.Open(fileName)
+		err := mh.storageParams.index[fileName].forEach(func(key recordKey, pos position) error {
+			if _, found := sources[key]; !found {
+				sources[key] = source{fileName, pos}
+			}
+			return nil
+		})
 		if err != nil {
-			mergable.Close()
-			mh.Res <- err
-			return
+			return err
 		}
-		hash, ok := mh.storageParams.index[fileName]
-		if !ok {
-			mergable.Close()
-			mh.Res <- err
-			return
+	}
+	order := make([]recordKey, 0, len(sources))
+	for key, src := range sources {
+		// nothing older is left after the merge, so tombstones can be
+		// dropped
+		if !src.pos.deleted {
+			order = append(order, key)
 		}
+	}
+	if mh.storageParams.sorted {
+		sort.Slice(order, func(i, j int) bool { return order[i].less(order[j]) })
+	}
 
-		for key, offset := range hash {
-			if _, found := segmentHash[key]; !found {
-				if value, _, err := searchValue(mergable, offset); err != nil {
-					mergable.Close()
-					mh.Res <- err
-					return
-				} else {
-					e := entry{
-						key:   key,
-						value: value,
-						sum:   getHashSum(key, value),
-					}
-					encoded := e.Encode()
-					if n, err := segment.Write(encoded); err != nil {
-						mergable.Close()
-						mh.Res <- err
-						return
-					} else {
-						segmentHash[key] = segmentOffset
-						segmentOffset += int64(n)
-					}
-				}
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	var segmentOffset int64
+	segmentHash := make(hashIndex)
+	var blocks *blocksBuilder
+	if mh.storageParams.sorted {
+		blocks = newBlocksBuilder(len(order))
+	}
+	now := time.Now()
+	for _, key := range order {
+		src := sources[key]
+		mergable, ok := files[src.fileName]
+		if !ok {
+			if mergable, err = os.Open(src.fileName); err != nil {
+				return err
 			}
+			files[src.fileName] = mergable
+		}
+		e, err := searchEntry(mergable, src.pos.offset, mh.codec.maxRecordSize())
+		if err != nil {
+			return err
+		}
+		// records are repacked, so the merged segment follows the current
+		// codec settings
+		if err := mh.codec.unpack(&e); err != nil {
+			return err
+		}
+		if e.expired(now) {
+			continue
+		}
+		rawSize := int64(e.size())
+		if err := mh.codec.pack(&e); err != nil {
+			return err
+		}
+		n, err := segment.Write(e.Encode())
+		if err != nil {
+			return err
 		}
-		mergable.Close()
+		segmentHash[key] = position{offset: segmentOffset, size: int64(n), rawSize: rawSize}
+		if blocks != nil {
+			blocks.add(key, segmentOffset)
+		}
+		segmentOffset += int64(n)
 	}
 
-	if err := os.RemoveAll(mh.storageParams.container); err != nil {
-		mh.Res <- err
-		return
+	var index segmentIndex = segmentHash
+	if blocks != nil {
+		if index, err = blocks.write(segmentPath, segmentOffset, mh.codec); err != nil {
+			return err
+		}
+	} else if mh.storageParams.diskIndex {
+		if index, err = writeDiskIndex(segmentPath, segmentHash, nil); err != nil {
+			return err
+		}
 	}
+
+	// the new container is used after a restart once CURRENT names it
+	if err := segment.Sync(); err != nil {
+		return err
+	}
+	if err := writeCurrentContainer(dir, filepath.Base(container)); err != nil {
+		return err
+	}
+	complete = true
+
 	mh.mtx.Lock()
+	oldContainer := mh.storageParams.container
 	mh.storageParams.container = container
 	for _, key := range keys {
 		if key != mh.storageParams.out {
 			// safely deleting old hash indices
 			delete(mh.storageParams.index, key)
+			delete(mh.storageParams.drops, key)
 		}
 	}
-	mh.storageParams.index[segmentPath] = segmentHash
+	mh.storageParams.index[segmentPath] = index
+	mh.storageParams.sealedSize = segmentOffset
 	mh.mtx.Unlock()
-	mh.Res <- nil
-	return
+	// the old files are removed only when no index refers to them
+	return os.RemoveAll(oldContainer)
 }
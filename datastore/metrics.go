@@ -0,0 +1,29 @@
+package datastore
+
+import "time"
+
+// Metrics receives measurements of the database operations. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// ObservePut reports every single record write: puts, deletes and
+	// bucket drops.
+	ObservePut(d time.Duration, err error)
+	// ObserveGet reports every read. Misses are reported with ErrNotFound,
+	// corrupted records with ErrHashSums.
+	ObserveGet(d time.Duration, err error)
+	// ObserveWrite reports a batch of records processed by the write loop.
+	ObserveWrite(records int, bytes int64, d time.Duration)
+	// ObserveMerge reports a finished merge of the sealed segments.
+	ObserveMerge(d time.Duration, err error)
+	// SetStorage reports the number of sealed segments and the size of
+	// all the data files after every write batch and merge.
+	SetStorage(segments int, bytes int64)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObservePut(time.Duration, error)        {}
+func (nopMetrics) ObserveGet(time.Duration, error)        {}
+func (nopMetrics) ObserveWrite(int, int64, time.Duration) {}
+func (nopMetrics) ObserveMerge(time.Duration, error)      {}
+func (nopMetrics) SetStorage(int, int64)                  {}
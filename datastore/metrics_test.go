@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	mtx                     sync.Mutex
+	puts, gets, misses      int
+	mismatches, merges      int
+	writtenRecords          int
+	writtenBytes, diskBytes int64
+	segments                int
+}
+
+func (m *testMetrics) ObservePut(_ time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.puts++
+}
+
+func (m *testMetrics) ObserveGet(_ time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.gets++
+	if err == ErrNotFound {
+		m.misses++
+	} else if err == ErrHashSums {
+		m.mismatches++
+	}
+}
+
+func (m *testMetrics) ObserveWrite(records int, bytes int64, _ time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.writtenRecords += records
+	m.writtenBytes += bytes
+}
+
+func (m *testMetrics) ObserveMerge(time.Duration, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.merges++
+}
+
+func (m *testMetrics) SetStorage(segments int, bytes int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.segments, m.diskBytes = segments, bytes
+}
+
+func TestDb_Metrics(t *testing.T) {
+	m := new(testMetrics)
+	db := newTestDb(t, "test-metrics-db", WithMetrics(m))
+
+	// enough records for two rotations and a merge
+	for i := 0; i < 6; i++ {
+		for key, value := range testValues {
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	db.Get("key1")
+	db.Get("missing")
+	e := entry{key: "key2", value: "value2", sum: getHashSum("key2", "bad")}
+	db.writeHash(e, e.Encode())
+	db.Get("key2")
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.puts != 18 || m.writtenRecords != 18 {
+		t.Errorf("Unexpected writes count %d, %d", m.puts, m.writtenRecords)
+	}
+	if m.gets != 3 || m.misses != 1 || m.mismatches != 1 {
+		t.Errorf("Unexpected gets %d, misses %d, mismatches %d", m.gets, m.misses, m.mismatches)
+	}
+	if m.merges == 0 || m.segments != 1 {
+		t.Errorf("Unexpected merges %d, segments %d", m.merges, m.segments)
+	}
+	if m.writtenBytes != 18*42 || m.diskBytes <= 0 {
+		t.Errorf("Unexpected sizes written %d, on disk %d", m.writtenBytes, m.diskBytes)
+	}
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"context"
+	"os"
+	"sort"
+)
+
+// GetMany returns the values of the keys found in the database, missing
+// keys are left out of the result.
+func (db *Db) GetMany(keys []string) (map[string]string, error) {
+	return db.getMany(context.Background(), "", keys)
+}
+
+func (db *Db) GetManyContext(ctx context.Context, keys []string) (map[string]string, error) {
+	return db.getMany(ctx, "", keys)
+}
+
+func (b *Bucket) GetMany(keys []string) (map[string]string, error) {
+	return b.db.getMany(context.Background(), b.name, keys)
+}
+
+func (b *Bucket) GetManyContext(ctx context.Context, keys []string) (map[string]string, error) {
+	return b.db.getMany(ctx, b.name, keys)
+}
+
+// getMany looks all the keys up at once and then reads the records file
+// by file in the order of their offsets, so every file is opened once.
+func (db *Db) getMany(ctx context.Context, bucket string, keys []string) (map[string]string, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	type found struct {
+		key string
+		pos position
+	}
+	files := make(map[string][]found)
+	opened := make(map[string]*os.File)
+	defer func() {
+		for _, file := range opened {
+			file.Close()
+		}
+	}()
+	db.mtx.Lock()
+	names := getSortedKeys(db.params.index)
+	for _, key := range keys {
+		for i := len(names) - 1; i >= 0; i-- {
+			pos, ok, err := db.params.index[names[i]].find(recordKey{bucket, key})
+			if err != nil {
+				db.mtx.Unlock()
+				return nil, err
+			} else if ok {
+				if !pos.deleted {
+					files[names[i]] = append(files[names[i]], found{key, pos})
+				}
+				break
+			}
+		}
+	}
+	// the files are opened under the lock, so a concurrent merge can't
+	// remove them before they are read
+	for fileName := range files {
+		file, err := os.Open(fileName)
+		if err != nil {
+			db.mtx.Unlock()
+			return nil, err
+		}
+		opened[fileName] = file
+	}
+	db.mtx.Unlock()
+
+	res := make(map[string]string)
+	for fileName, records := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].pos.offset < records[j].pos.offset })
+		for _, r := range records {
+			value, err := db.readRecord(opened[fileName], r.pos)
+			if err == ErrNotFound {
+				// expired
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			res[r.key] = value
+		}
+	}
+	return res, nil
+}
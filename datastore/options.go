@@ -0,0 +1,106 @@
+package datastore
+
+// Option configures the database opened with NewDb.
+type Option func(*Db)
+
+// WithCompression enables compression of values which are at least
+// threshold bytes long. Records are compressed only when it saves space.
+func WithCompression(threshold int) Option {
+	return func(db *Db) {
+		db.codec.compressThreshold = threshold
+	}
+}
+
+// WithEncryption enables AES-GCM encryption of values with the keys of the
+// keyring. Keys should be 16, 24 or 32 bytes long.
+func WithEncryption(keyring Keyring) Option {
+	return func(db *Db) {
+		db.codec.keyring = keyring
+	}
+}
+
+// WithDiskIndex keeps only a bloom filter and a sparse index of every
+// sealed segment in memory. The full index of a segment is written to disk
+// next to it, so memory usage depends on the number of segments rather than
+// on the number of keys.
+func WithDiskIndex() Option {
+	return func(db *Db) {
+		db.params.diskIndex = true
+	}
+}
+
+// WithSortedSegments makes merges write segments sorted by key, so only
+// the first key of every block of records is kept in memory and lookups
+// read a single block. Segments sealed between merges use the disk index,
+// see WithDiskIndex.
+func WithSortedSegments() Option {
+	return func(db *Db) {
+		db.params.sorted = true
+		db.params.diskIndex = true
+	}
+}
+
+// WithMaxKeySize limits the length of keys, DefaultMaxKeySize is used by
+// default.
+func WithMaxKeySize(n int) Option {
+	return func(db *Db) {
+		db.codec.maxKeySize = n
+	}
+}
+
+// WithMaxValueSize limits the length of values, DefaultMaxValueSize is used
+// by default. Records already stored must fit the limit, otherwise the
+// database fails to open.
+func WithMaxValueSize(n int) Option {
+	return func(db *Db) {
+		db.codec.maxValueSize = n
+	}
+}
+
+// SyncMode controls when written records are flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncNone leaves flushing to the operating system, records written
+	// shortly before a crash may be lost.
+	SyncNone SyncMode = iota
+	// SyncAlways flushes the output file after every write.
+	SyncAlways
+)
+
+// WithSyncMode sets the sync mode, SyncNone is used by default. Sealed
+// segments are synced in any mode.
+func WithSyncMode(mode SyncMode) Option {
+	return func(db *Db) {
+		db.syncMode = mode
+	}
+}
+
+// DefaultMergeThreshold merges the segments as soon as two of them are
+// sealed.
+const DefaultMergeThreshold = 2
+
+// WithMergeThreshold sets the number of sealed segments which starts a
+// merge, zero disables merges. Larger values trade disk space and lookup
+// time for less merge work.
+func WithMergeThreshold(segments int) Option {
+	return func(db *Db) {
+		db.mergeThreshold = segments
+	}
+}
+
+// WithMetrics reports the database measurements to m.
+func WithMetrics(m Metrics) Option {
+	return func(db *Db) {
+		db.metrics = m
+	}
+}
+
+// WithReadOnly opens the database without taking the directory lock, so it
+// can be used along with the process which owns the directory. No files are
+// created or changed: writes fail with ErrReadOnly and no merges are run.
+func WithReadOnly() Option {
+	return func(db *Db) {
+		db.readOnly = true
+	}
+}
@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// scan calls fn for the latest value of every live key accepted by the
+// filter, in the key order. The set of keys is taken at the beginning of
+// the scan, later writes are not visible to it.
+func (db *Db) scan(filter func(recordKey) bool, fn func(recordKey, string) error) error {
+	_, _, err := db.scanPage(filter, 0, fn)
+	return err
+}
+
+// scanPage is scan of the first limit keys accepted by the filter, all of
+// them when limit is zero. Only these keys are kept in memory and sorted.
+// It returns the last of the keys and whether the limit was reached.
+// Deleted and expired keys count towards the limit, but are not passed
+// to fn.
+func (db *Db) scanPage(filter func(recordKey) bool, limit int, fn func(recordKey, string) error) (last recordKey, full bool, err error) {
+	if db.isClosed() {
+		return last, false, ErrClosed
+	}
+	type source struct {
+		file *os.File
+		pos  position
+	}
+	var (
+		files     []*os.File
+		snapshots []indexSnapshot
+	)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+		for _, s := range snapshots {
+			s.close()
+		}
+	}()
+	err = func() error {
+		// the files are opened under the lock, so a merge can't remove
+		// them before they are read, the indices are read after it
+		db.mtx.Lock()
+		defer db.mtx.Unlock()
+		keys := getSortedKeys(db.params.index)
+		for _, name := range keys {
+			file, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		var err error
+		snapshots, err = db.snapshotIndicesLocked(keys)
+		return err
+	}()
+	if err != nil {
+		return last, false, err
+	}
+
+	// the files are read from the oldest one, so the newer records replace
+	// the older ones, the greatest kept key is evicted at the limit
+	sources := make(map[recordKey]source)
+	var kept keyHeap
+	for i, s := range snapshots {
+		err := s.forEach(func(key recordKey, pos position) error {
+			if !filter(key) {
+				return nil
+			}
+			if _, found := sources[key]; !found && limit > 0 {
+				if len(kept) == limit {
+					if !key.less(kept[0]) {
+						return nil
+					}
+					delete(sources, heap.Pop(&kept).(recordKey))
+				}
+				heap.Push(&kept, key)
+			}
+			sources[key] = source{files[i], pos}
+			return nil
+		})
+		if err != nil {
+			return last, false, err
+		}
+	}
+	if full = limit > 0 && len(kept) == limit; full {
+		last = kept[0]
+	}
+
+	order := make([]recordKey, 0, len(sources))
+	for key, src := range sources {
+		if !src.pos.deleted {
+			order = append(order, key)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].less(order[j]) })
+	for _, key := range order {
+		src := sources[key]
+		value, err := db.readRecord(src.file, src.pos)
+		if err == ErrNotFound {
+			// expired
+			continue
+		} else if err != nil {
+			return last, false, err
+		}
+		if err := fn(key, value); err != nil {
+			return last, false, err
+		}
+	}
+	return last, full, nil
+}
+
+// keyHeap keeps the greatest key on top.
+type keyHeap []recordKey
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[j].less(h[i]) }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(recordKey)) }
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// Scan calls fn for every live key of all the buckets ordered by bucket
+// and key. The scan stops at the first error returned by fn.
+func (db *Db) Scan(fn func(bucket, key, value string) error) error {
+	return db.scan(func(recordKey) bool { return true }, func(key recordKey, value string) error {
+		return fn(key.bucket, key.key, value)
+	})
+}
+
+// Scan calls fn for every live key of the bucket starting with the prefix
+// in the key order.
+func (b *Bucket) Scan(prefix string, fn func(key, value string) error) error {
+	filter := func(key recordKey) bool {
+		return key.bucket == b.name && strings.HasPrefix(key.key, prefix)
+	}
+	return b.db.scan(filter, func(key recordKey, value string) error {
+		return fn(key.key, value)
+	})
+}
+
+// ScanPage calls fn for the live keys among the next limit keys of the
+// bucket in the key order, starting after the key when hasAfter is set.
+// It returns the last of these keys and whether more keys may follow it,
+// so a full iteration takes the next page after the returned key. Pages
+// may be shorter than the limit because of deleted and expired keys.
+func (b *Bucket) ScanPage(after string, hasAfter bool, limit int, fn func(key, value string) error) (last string, more bool, err error) {
+	if limit <= 0 {
+		return "", false, fmt.Errorf("scan page limit must be positive")
+	}
+	filter := func(key recordKey) bool {
+		return key.bucket == b.name && (!hasAfter || key.key > after)
+	}
+	lastKey, more, err := b.db.scanPage(filter, limit, func(key recordKey, value string) error {
+		return fn(key.key, value)
+	})
+	return lastKey.key, more, err
+}
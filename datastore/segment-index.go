@@ -0,0 +1,66 @@
+package datastore
+
+import "os"
+
+// segmentIndex maps the keys of a single file to record positions.
+type segmentIndex interface {
+	find(key recordKey) (position, bool, error)
+	// forEach calls fn for every key of the file until fn returns an error.
+	forEach(fn func(recordKey, position) error) error
+	// dropBucket forgets the keys of the bucket.
+	dropBucket(bucket string)
+	// snapshot must be called under the lock of the database, the result
+	// may be iterated after the lock is released.
+	snapshot() (indexSnapshot, error)
+}
+
+// indexSnapshot iterates the keys of a file as they were when it was
+// taken. The files read by the iteration are already open, so a merge
+// can't remove them in the meantime.
+type indexSnapshot struct {
+	file    *os.File
+	forEach func(fn func(recordKey, position) error) error
+}
+
+func (s indexSnapshot) close() {
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+func (k recordKey) less(other recordKey) bool {
+	if k.bucket != other.bucket {
+		return k.bucket < other.bucket
+	}
+	return k.key < other.key
+}
+
+func (h hashIndex) find(key recordKey) (position, bool, error) {
+	pos, ok := h[key]
+	return pos, ok, nil
+}
+
+func (h hashIndex) forEach(fn func(recordKey, position) error) error {
+	for key, pos := range h {
+		if err := fn(key, pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h hashIndex) snapshot() (indexSnapshot, error) {
+	c := make(hashIndex, len(h))
+	for key, pos := range h {
+		c[key] = pos
+	}
+	return indexSnapshot{forEach: c.forEach}, nil
+}
+
+func (h hashIndex) dropBucket(bucket string) {
+	for key := range h {
+		if key.bucket == bucket {
+			delete(h, key)
+		}
+	}
+}
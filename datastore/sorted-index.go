@@ -0,0 +1,200 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Merges write sorted segments when the sorted mode is enabled. Records of
+// such segments are ordered by bucket and key and grouped into blocks. The
+// blocks file next to the segment holds:
+//
+//	bloom   bloom filter of all the keys
+//	sparse  u16 bucket len | bucket | u32 key len | key | i64 block offset,
+//	        the first key of every block
+//	footer  i64 sparse offset
+const (
+	blocksSuffix    = ".blocks"
+	sortedBlockSize = 4096
+)
+
+type blocksBuilder struct {
+	filter *bloomFilter
+	blocks []indexBlock
+}
+
+func newBlocksBuilder(keys int) *blocksBuilder {
+	return &blocksBuilder{filter: newBloomFilter(keys)}
+}
+
+// add registers the record written at the offset. Records must be added
+// in the key order.
+func (bb *blocksBuilder) add(key recordKey, offset int64) {
+	bb.filter.add(key)
+	if len(bb.blocks) == 0 || offset-bb.blocks[len(bb.blocks)-1].offset >= sortedBlockSize {
+		bb.blocks = append(bb.blocks, indexBlock{first: key, offset: offset})
+	}
+}
+
+// write stores the blocks file of the segment of the given size.
+func (bb *blocksBuilder) write(segmentPath string, size int64, codec *recordCodec) (*sortedIndex, error) {
+	buf := bb.filter.encode()
+	sparseOffset := len(buf)
+	buf = appendBlocks(buf, bb.blocks)
+	var footer [8]byte
+	binary.LittleEndian.PutUint64(footer[:], uint64(sparseOffset))
+	buf = append(buf, footer[:]...)
+
+	path := segmentPath + blocksSuffix
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return &sortedIndex{
+		path:   segmentPath,
+		filter: bb.filter,
+		blocks: bb.blocks,
+		end:    size,
+		codec:  codec,
+	}, nil
+}
+
+// sortedIndex keeps a bloom filter and the first key of every block of
+// a sorted segment in memory. Lookups read a single block of records.
+type sortedIndex struct {
+	droppedBuckets
+	path   string
+	filter *bloomFilter
+	blocks []indexBlock
+	end    int64
+	codec  *recordCodec
+}
+
+func loadSortedIndex(segmentPath string, codec *recordCodec) (*sortedIndex, error) {
+	info, err := os.Stat(segmentPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(segmentPath + blocksSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("corrupted blocks file of %s", segmentPath)
+	}
+	sparseOffset := binary.LittleEndian.Uint64(data[len(data)-8:])
+	if sparseOffset > uint64(len(data)-8) {
+		return nil, fmt.Errorf("corrupted blocks file of %s", segmentPath)
+	}
+	si := &sortedIndex{path: segmentPath, end: info.Size(), codec: codec}
+	if si.filter, err = decodeBloomFilter(data[:sparseOffset]); err != nil {
+		return nil, err
+	}
+	if si.blocks, err = readBlocks(data[sparseOffset : len(data)-8]); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+func (si *sortedIndex) find(key recordKey) (position, bool, error) {
+	if si.isDropped(key.bucket) || !si.filter.mayContain(key) {
+		return position{}, false, nil
+	}
+	i := findBlock(si.blocks, key)
+	if i < 0 {
+		return position{}, false, nil
+	}
+	end := si.end
+	if i+1 < len(si.blocks) {
+		end = si.blocks[i+1].offset
+	}
+
+	file, err := os.Open(si.path)
+	if err != nil {
+		return position{}, false, err
+	}
+	defer file.Close()
+	block := make([]byte, end-si.blocks[i].offset)
+	if _, err := file.ReadAt(block, si.blocks[i].offset); err != nil {
+		return position{}, false, err
+	}
+	in := bufio.NewReader(bytes.NewReader(block))
+	offset := si.blocks[i].offset
+	for {
+		e, n, err := readEntry(in, si.codec.maxRecordSize())
+		if err == io.EOF {
+			return position{}, false, nil
+		} else if err != nil {
+			return position{}, false, err
+		}
+		found := recordKey{e.bucket, e.key}
+		if found == key {
+			pos := position{offset: offset, size: int64(n), rawSize: int64(n)}
+			if e.flags&(flagCompressed|flagEncrypted) != 0 {
+				if err := si.codec.unpack(&e); err != nil {
+					return position{}, false, err
+				}
+				pos.rawSize = int64(e.size())
+			}
+			return pos, true, nil
+		} else if key.less(found) {
+			return position{}, false, nil
+		}
+		offset += int64(n)
+	}
+}
+
+func (si *sortedIndex) forEach(fn func(recordKey, position) error) error {
+	file, err := os.Open(si.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return si.forEachIn(file, fn)
+}
+
+func (si *sortedIndex) snapshot() (indexSnapshot, error) {
+	file, err := os.Open(si.path)
+	if err != nil {
+		return indexSnapshot{}, err
+	}
+	return indexSnapshot{file: file, forEach: func(fn func(recordKey, position) error) error {
+		return si.forEachIn(file, fn)
+	}}, nil
+}
+
+// forEachIn reads the records from the opened segment, the raw sizes of
+// the packed ones are found by unpacking them.
+func (si *sortedIndex) forEachIn(file *os.File, fn func(recordKey, position) error) error {
+	in := bufio.NewReaderSize(io.NewSectionReader(file, 0, si.end), bufSize)
+	var offset int64
+	for {
+		e, n, err := readEntry(in, si.codec.maxRecordSize())
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		pos := position{offset: offset, size: int64(n), rawSize: int64(n)}
+		offset += int64(n)
+		if si.isDropped(e.bucket) {
+			continue
+		}
+		if e.flags&(flagCompressed|flagEncrypted) != 0 {
+			if err := si.codec.unpack(&e); err != nil {
+				return err
+			}
+			pos.rawSize = int64(e.size())
+		}
+		if err := fn(recordKey{e.bucket, e.key}, pos); err != nil {
+			return err
+		}
+	}
+}
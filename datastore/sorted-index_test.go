@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_SortedSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-sorted-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := []Option{WithSortedSegments(), WithCompression(64)}
+	db, err := NewDb(dir, 4096, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	values := make(map[string]string)
+	for i := 0; i < 600; i++ {
+		key, value := fmt.Sprintf("key%03d", (i*7)%300), fmt.Sprintf("value%d", i)
+		if i%50 == 0 {
+			value = strings.Repeat(value, 20)
+		}
+		if err := db.Bucket(fmt.Sprintf("b%d", i%2)).Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		values[fmt.Sprintf("b%d/%s", i%2, key)] = value
+	}
+
+	check := func(t *testing.T) {
+		var sorted *sortedIndex
+		for _, index := range db.params.index {
+			if si, ok := index.(*sortedIndex); ok {
+				sorted = si
+			}
+		}
+		if sorted == nil {
+			t.Fatal("No sorted segments")
+		}
+		if len(sorted.blocks) < 2 {
+			t.Errorf("Expected several blocks, got %d", len(sorted.blocks))
+		}
+
+		f, err := os.Open(sorted.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var prev *recordKey
+		for in := bufio.NewReader(f); ; {
+			e, _, err := readEntry(in, 1<<20)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			key := recordKey{e.bucket, e.key}
+			if prev != nil && !prev.less(key) {
+				t.Fatalf("Segment is not sorted: %v after %v", key, *prev)
+			}
+			prev = &key
+		}
+
+		// lookups report the raw sizes of the packed records as the scans do
+		packed := 0
+		err = sorted.forEach(func(key recordKey, pos position) error {
+			if pos.rawSize == pos.size {
+				return nil
+			}
+			packed++
+			if found, ok, err := sorted.find(key); err != nil || !ok || found != pos {
+				t.Errorf("Unexpected %v lookup result %+v, expected %+v", key, found, pos)
+			}
+			return nil
+		})
+		if err != nil || packed == 0 {
+			t.Errorf("No packed records in the sorted segment: %v", err)
+		}
+
+		for name, value := range values {
+			parts := strings.SplitN(name, "/", 2)
+			if found, err := db.Bucket(parts[0]).Get(parts[1]); err != nil || found != value {
+				t.Errorf("Cannot get %s: %v", name, err)
+			}
+		}
+		for _, key := range []string{"key", "key999", "zzz"} {
+			if _, err := db.Bucket("b0").Get(key); err != ErrNotFound {
+				t.Errorf("Unexpected %s lookup result: %v", key, err)
+			}
+		}
+		stats := mustStats(t, db)
+		if stats.Total.Keys != len(values) {
+			t.Errorf("Unexpected keys count %d, expected %d", stats.Total.Keys, len(values))
+		}
+		if stats.Total.RawBytes <= stats.Total.Bytes {
+			t.Errorf("Compressed records are not accounted %+v", stats.Total)
+		}
+	}
+	t.Run("merged", check)
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDb(dir, 4096, opts...); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
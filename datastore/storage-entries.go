@@ -1,8 +1,44 @@
 package datastore
 
+import "sync"
+
 type storageEntries struct {
 	segmentCounter int
-	container string
-	out string
-	index indexes
+	container      string
+	out            string
+	index          indexes
+	// drops lists the buckets dropped by the records of each file.
+	drops map[string][]string
+	// diskIndex keeps only bloom filters and sparse indices of sealed
+	// segments in memory.
+	diskIndex bool
+	// sorted makes merges write segments sorted by key.
+	sorted bool
+	// sealedSize is the total size of the sealed segments.
+	sealedSize int64
+}
+
+// current returns the index of the file being written.
+func (se *storageEntries) current() hashIndex {
+	return se.index[se.out].(hashIndex)
+}
+
+// dropBucket removes every key of the bucket from all the indices.
+func (se *storageEntries) dropBucket(fileName, bucket string) {
+	for _, index := range se.index {
+		index.dropBucket(bucket)
+	}
+	se.drops[fileName] = append(se.drops[fileName], bucket)
+}
+
+// seal moves the index of the sealed segment to disk.
+func (se *storageEntries) seal(segmentPath string, mtx *sync.Mutex) error {
+	di, err := writeDiskIndex(segmentPath, se.index[segmentPath], se.drops[segmentPath])
+	if err != nil {
+		return err
+	}
+	mtx.Lock()
+	se.index[segmentPath] = di
+	mtx.Unlock()
+	return nil
 }
@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrNotInteger is returned by Incr for values which are not decimal
+// 64-bit integers or when the result overflows.
+var ErrNotInteger = fmt.Errorf("value is not an integer or out of range")
+
+// expiresAt converts the time to live to the stored expiration time.
+func expiresAt(ttl time.Duration) int64 {
+	return time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+}
+
+// PutTTL puts the value which expires after ttl. Expired keys are not
+// visible and are removed by the next merge.
+func (b *Bucket) PutTTL(key, value string, ttl time.Duration) error {
+	return b.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (b *Bucket) PutTTLContext(ctx context.Context, key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("time to live must be positive")
+	}
+	e := entry{bucket: b.name, key: key, value: value, flags: flagExpires, expires: expiresAt(ttl)}
+	return b.db.write(ctx, e)
+}
+
+// Expire sets the time to live of an existing key, the key is deleted if
+// ttl is not positive. It reports whether the key exists.
+func (b *Bucket) Expire(key string, ttl time.Duration) (bool, error) {
+	return b.ExpireContext(context.Background(), key, ttl)
+}
+
+func (b *Bucket) ExpireContext(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	found := false
+	err := b.db.update(ctx, func() ([]entry, error) {
+		e, err := b.db.readLatest(recordKey{b.name, key})
+		if err == ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		found = true
+		if ttl <= 0 {
+			return []entry{{bucket: b.name, key: key, flags: flagTombstone}}, nil
+		}
+		return []entry{{bucket: b.name, key: key, value: e.value, flags: flagExpires, expires: expiresAt(ttl)}}, nil
+	})
+	return found, err
+}
+
+// Incr adds delta to the integer value of the key and returns the result.
+// Missing keys count as zero, the time to live of the key is kept.
+func (b *Bucket) Incr(key string, delta int64) (int64, error) {
+	return b.IncrContext(context.Background(), key, delta)
+}
+
+func (b *Bucket) IncrContext(ctx context.Context, key string, delta int64) (int64, error) {
+	var res int64
+	err := b.db.update(ctx, func() ([]entry, error) {
+		var n int64
+		e, err := b.db.readLatest(recordKey{b.name, key})
+		if err == nil {
+			if n, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+				return nil, ErrNotInteger
+			}
+		} else if err == ErrNotFound {
+			e = entry{}
+		} else {
+			return nil, err
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, ErrNotInteger
+		}
+		res = n + delta
+		next := entry{bucket: b.name, key: key, value: strconv.FormatInt(res, 10)}
+		if e.flags&flagExpires != 0 {
+			next.flags, next.expires = flagExpires, e.expires
+		}
+		return []entry{next}, nil
+	})
+	return res, err
+}
@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_TTL(t *testing.T) {
+	db := newTestDb(t, "test-ttl-db")
+	bucket := db.Bucket("")
+	if err := bucket.PutTTL("short", "value", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.PutTTL("long", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := bucket.Expire("plain", 50*time.Millisecond); !found || err != nil {
+		t.Errorf("Unexpected Expire result %t, %v", found, err)
+	}
+	if found, err := bucket.Expire("missing", time.Hour); found || err != nil {
+		t.Errorf("Unexpected Expire result of a missing key %t, %v", found, err)
+	}
+	if value, err := db.Get("short"); err != nil || value != "value" {
+		t.Errorf("Unexpected value before expiration %q, %v", value, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	for _, key := range []string{"short", "plain"} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected %s to expire, got %v", key, err)
+		}
+	}
+	if value, err := db.Get("long"); err != nil || value != "value" {
+		t.Errorf("Unexpected value of a live key %q, %v", value, err)
+	}
+	if values, err := db.GetMany([]string{"short", "long"}); err != nil || len(values) != 1 {
+		t.Errorf("Unexpected GetMany result %v, %v", values, err)
+	}
+	if n := len(dump(t, db)); n != 1 {
+		t.Errorf("Scan returned %d records, expected 1", n)
+	}
+}
+
+func TestDb_Incr(t *testing.T) {
+	db := newTestDb(t, "test-incr-db")
+	bucket := db.Bucket("counters")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := bucket.Incr("counter", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value, err := bucket.Get("counter"); err != nil || value != "100" {
+		t.Errorf("Unexpected counter value %q, %v", value, err)
+	}
+
+	if err := bucket.PutTTL("expiring", "41", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bucket.Incr("expiring", 1); err != nil || n != 42 {
+		t.Errorf("Unexpected result %d, %v", n, err)
+	}
+	if e, err := db.readLatest(recordKey{"counters", "expiring"}); err != nil || e.flags&flagExpires == 0 {
+		t.Errorf("Incr dropped the time to live: %+v, %v", e, err)
+	}
+
+	if err := bucket.Put("text", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Incr("text", 1); err != ErrNotInteger {
+		t.Errorf("Expected ErrNotInteger, got %v", err)
+	}
+	if err := bucket.Put("max", "9223372036854775807"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Incr("max", 1); err != ErrNotInteger {
+		t.Errorf("Expected ErrNotInteger on overflow, got %v", err)
+	}
+}
+
+func TestDb_TTLMerge(t *testing.T) {
+	db := newTestDb(t, "test-ttl-merge-db")
+	if err := db.Bucket("").PutTTL("expiring", "value", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// seals a couple of segments, so they are merged
+	for i := 0; i < 12; i++ {
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := mustStats(t, db).Buckets[""].Keys; keys != 1 {
+		t.Errorf("Expired key is kept by merge, %d keys", keys)
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ErrWatchOverflow ends a watch which didn't keep up with the writes.
+var ErrWatchOverflow = fmt.Errorf("watcher fell behind the writes")
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	EventDropBucket
+)
+
+// Event describes a record written to the database. Key and Value are
+// empty for EventDropBucket, Value is empty for EventDelete.
+type Event struct {
+	Type        EventType
+	Bucket, Key string
+	Value       string
+}
+
+// Watcher receives the events of the writes made after it was created,
+// in the order of the writes.
+type Watcher struct {
+	events chan Event
+	db     *Db
+	once   sync.Once
+	err    error
+}
+
+// Events returns the channel of the events. It is closed when the watcher
+// or the database is closed, or when the watcher overflows.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err tells why the events channel was closed: ErrWatchOverflow,
+// ErrClosed or nil if the watcher was closed with Close.
+func (w *Watcher) Err() error {
+	w.db.watchMtx.Lock()
+	defer w.db.watchMtx.Unlock()
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.db.watchMtx.Lock()
+	defer w.db.watchMtx.Unlock()
+	w.stop(nil)
+}
+
+// stop closes the events channel, the caller must hold watchMtx.
+func (w *Watcher) stop(err error) {
+	w.once.Do(func() {
+		delete(w.db.watchers, w)
+		w.err = err
+		close(w.events)
+	})
+}
+
+// Watch starts watching the writes. The write loop never waits for
+// watchers: a watcher with more than buffer pending events is stopped
+// with ErrWatchOverflow.
+func (db *Db) Watch(buffer int) (*Watcher, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	db.watchMtx.Lock()
+	defer db.watchMtx.Unlock()
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	w := &Watcher{events: make(chan Event, buffer), db: db}
+	if db.watchers == nil {
+		db.watchers = make(map[*Watcher]struct{})
+	}
+	db.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// notify passes the written plain entry to the watchers.
+func (db *Db) notify(e *entry) {
+	db.watchMtx.Lock()
+	defer db.watchMtx.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+	ev := Event{Type: EventPut, Bucket: e.bucket, Key: e.key, Value: e.value}
+	if e.flags&flagTombstone != 0 {
+		ev.Type = EventDelete
+	} else if e.flags&flagDropBucket != 0 {
+		ev.Type = EventDropBucket
+	}
+	for w := range db.watchers {
+		select {
+		case w.events <- ev:
+		default:
+			w.stop(ErrWatchOverflow)
+		}
+	}
+}
+
+// stopWatchers ends all the watches when the database is closed.
+func (db *Db) stopWatchers() {
+	db.watchMtx.Lock()
+	defer db.watchMtx.Unlock()
+	for w := range db.watchers {
+		w.stop(ErrClosed)
+	}
+}
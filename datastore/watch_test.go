@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDb_Watch(t *testing.T) {
+	db := newTestDb(t, "test-watch-db")
+	w, err := db.Watch(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := db.Bucket("b")
+	if err := bucket.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Drop(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Event{
+		{Type: EventPut, Bucket: "b", Key: "key", Value: "value"},
+		{Type: EventDelete, Bucket: "b", Key: "key"},
+		{Type: EventDropBucket, Bucket: "b"},
+	}
+	for _, e := range expected {
+		if got := <-w.Events(); !reflect.DeepEqual(got, e) {
+			t.Errorf("Expected event %+v, got %+v", e, got)
+		}
+	}
+
+	// nobody reads the events, so the watcher overflows
+	for i := 0; i < 5; i++ {
+		if err := db.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	for range w.Events() {
+		n++
+	}
+	if n != 4 || w.Err() != ErrWatchOverflow {
+		t.Errorf("Unexpected overflow: %d events, %v", n, w.Err())
+	}
+
+	w, err = db.Watch(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, ok := <-w.Events(); ok || w.Err() != ErrClosed {
+		t.Errorf("Watcher is not stopped on close: %v", w.Err())
+	}
+	if _, err := db.Watch(1); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
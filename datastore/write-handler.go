@@ -1,18 +1,30 @@
 package datastore
 
-func NewWriteHandler(clb func () bool) *WriteHandler {
+func NewWriteHandler(clb func() bool) *WriteHandler {
 	return &WriteHandler{
-		Req: make(chan entry),
-		Res: make(chan error),
-		closed: make(chan bool),
+		Req:        make(chan writeRequest),
+		done:       make(chan struct{}),
+		closed:     make(chan bool),
 		onWriteClb: clb,
 	}
 }
 
+// writeRequest carries a batch of entries to the write loop. The result is
+// sent to the buffered res channel, so the loop never waits for callers
+// which gave up.
+type writeRequest struct {
+	batch []entry
+	// prepare builds the batch in the write loop when set, so it sees no
+	// concurrent writes.
+	prepare func() ([]entry, error)
+	res     chan error
+}
+
 type WriteHandler struct {
-	Req chan entry
-	Res chan error
-	closed chan bool
+	Req chan writeRequest
+	// done is closed when the handler stops accepting requests.
+	done       chan struct{}
+	closed     chan bool
 	onWriteClb func() bool
 }
 
@@ -29,7 +41,6 @@ func (wh *WriteHandler) StartLoop() {
 }
 
 func (wh *WriteHandler) Close() {
-	close(wh.Req)
-	close(wh.Res)
+	close(wh.done)
 	<-wh.closed
 }
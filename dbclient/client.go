@@ -0,0 +1,308 @@
+// Package dbclient implements a client of the HTTP API of the db server.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("record does not exist")
+	ErrCorrupted = errors.New("record is corrupted")
+)
+
+// Error is an error reported by the server. It matches ErrNotFound and
+// ErrCorrupted with errors.Is.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("db: %d %s", e.Status, e.Code)
+	}
+	return fmt.Sprintf("db: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	switch e.Code {
+	case "not_found":
+		return ErrNotFound
+	case "checksum_mismatch", "corrupted":
+		return ErrCorrupted
+	}
+	return nil
+}
+
+const (
+	DefaultRetries = 2
+	DefaultBackoff = 100 * time.Millisecond
+
+	maxIdleConnsPerHost = 32
+	// maxErrorSize limits the error bodies read from the server
+	maxErrorSize = 64 << 10
+)
+
+type Client struct {
+	base    *url.URL
+	http    *http.Client
+	bucket  string
+	apiKey  string
+	retries int
+	backoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient makes the client send the requests with the given one.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithRetries sets the number of retries of the requests failed with
+// a transport error or an unavailable server. Delays between the attempts
+// start at backoff and double every time.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.backoff = backoff
+	}
+}
+
+// WithBucket makes the client address the keys of the bucket instead of
+// the default one.
+func WithBucket(name string) Option {
+	return func(c *Client) {
+		c.bucket = name
+	}
+}
+
+// WithAPIKey authenticates the requests with the key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// New creates a client of the server at baseURL, e.g. http://db:8091.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("bad db url %q", baseURL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+	c := &Client{base: base, retries: DefaultRetries, backoff: DefaultBackoff}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retries < 0 {
+		return nil, fmt.Errorf("retries must not be negative")
+	}
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+		c.http = &http.Client{Transport: transport}
+	}
+	// the API never redirects, a redirected request could reach another
+	// key or a different handler, so 3xx responses fail instead
+	hc := *c.http
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	c.http = &hc
+	return c, nil
+}
+
+type valueData struct {
+	Value string `json:"value"`
+}
+
+type mgetRequest struct {
+	Bucket string   `json:"bucket,omitempty"`
+	Keys   []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Values map[string]string `json:"values"`
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var res valueData
+	if err := c.do(ctx, http.MethodGet, c.keyURL(key), nil, &res); err != nil {
+		return "", err
+	}
+	return res.Value, nil
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.do(ctx, http.MethodPut, c.keyURL(key), &valueData{Value: value}, nil)
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, c.keyURL(key), nil, nil)
+}
+
+// MGet returns the values of the existing keys, the missing ones are
+// absent from the result.
+func (c *Client) MGet(ctx context.Context, keys []string) (map[string]string, error) {
+	var res mgetResponse
+	req := &mgetRequest{Bucket: c.bucket, Keys: keys}
+	if err := c.do(ctx, http.MethodPost, c.endpoint("_mget"), req, &res); err != nil {
+		return nil, err
+	}
+	if res.Values == nil {
+		res.Values = make(map[string]string)
+	}
+	return res.Values, nil
+}
+
+// keyURL escapes the key, so slashes and other special characters stay
+// a part of it.
+func (c *Client) keyURL(key string) string {
+	if c.bucket == "" {
+		return c.endpoint(escapeSegment(key))
+	}
+	return c.endpoint(escapeSegment(c.bucket) + "/" + escapeSegment(key))
+}
+
+// escapeSegment escapes a path segment. Segments of dots would be removed
+// by path cleaning and a leading underscore would turn the key into an
+// endpoint like _mget, so these characters are escaped as well.
+func escapeSegment(s string) string {
+	escaped := url.PathEscape(s)
+	if strings.Trim(s, ".") == "" {
+		return strings.ReplaceAll(escaped, ".", "%2E")
+	}
+	if strings.HasPrefix(escaped, "_") {
+		return "%5F" + escaped[1:]
+	}
+	return escaped
+}
+
+func (c *Client) endpoint(path string) string {
+	return c.base.String() + "/db/" + path
+}
+
+// do sends the request retrying it when the server is unreachable and
+// decodes the response into out.
+func (c *Client) do(ctx context.Context, method, target string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, target, body, out)
+		if attempt >= c.retries || !retryable(err) {
+			return err
+		}
+		if err := sleep(ctx, c.delay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, target string, body []byte, out interface{}) error {
+	var in io.Reader
+	if body != nil {
+		in = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, in)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// the connection is reused only when the body is read to the end
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("db: bad response: %w", err)
+	}
+	return nil
+}
+
+func decodeError(resp *http.Response) error {
+	res := &Error{Status: resp.StatusCode}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorSize))
+	if json.Unmarshal(data, res) != nil || res.Code == "" {
+		res.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "_"))
+		res.Message = strings.TrimSpace(string(data))
+	}
+	return res
+}
+
+// retryable reports whether the request may succeed when repeated: the
+// server could not be reached or is temporarily unavailable.
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var serr *Error
+	if errors.As(err, &serr) {
+		switch serr.Status {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var uerr *url.Error
+	return errors.As(err, &uerr)
+}
+
+// delay returns the exponential backoff of the attempt with a jitter of
+// up to a half of it.
+func (c *Client) delay(attempt int) time.Duration {
+	d := c.backoff << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
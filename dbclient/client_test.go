@@ -0,0 +1,222 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc, opts ...Option) *Client {
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	c, err := New(server.URL, append([]Option{WithRetries(2, time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": code})
+}
+
+func TestClient_Requests(t *testing.T) {
+	var paths []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Unexpected authorization %q", auth)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]string{"value": "v"})
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"value":"a b"}` {
+				t.Errorf("Unexpected PUT body %s", body)
+			}
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}, WithBucket("b/1"), WithAPIKey("secret"))
+	ctx := context.Background()
+
+	if v, err := c.Get(ctx, "a/b?c"); err != nil || v != "v" {
+		t.Errorf("Unexpected Get result %q, %v", v, err)
+	}
+	if err := c.Put(ctx, "k", "a b"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Delete(ctx, "k%"); err != nil {
+		t.Error(err)
+	}
+	expected := []string{"GET /db/b%2F1/a%2Fb%3Fc", "PUT /db/b%2F1/k", "DELETE /db/b%2F1/k%25"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Unexpected requests %v", paths)
+	}
+}
+
+func TestClient_SpecialKeys(t *testing.T) {
+	var paths []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// the server routes by the escaped path, _mget is the only
+		// endpoint next to the keys
+		path := r.URL.EscapedPath()
+		if path == "/db/_mget" {
+			t.Errorf("Key request reached the mget endpoint")
+		}
+		paths = append(paths, path)
+		json.NewEncoder(w).Encode(map[string]string{"value": "v"})
+	})
+	for _, key := range []string{"a//b", "..", ".", "x/../y", "_mget"} {
+		if v, err := c.Get(context.Background(), key); err != nil || v != "v" {
+			t.Errorf("Unexpected Get result of %q: %q, %v", key, v, err)
+		}
+	}
+	expected := []string{"/db/a%2F%2Fb", "/db/%2E%2E", "/db/%2E", "/db/x%2F..%2Fy", "/db/%5Fmget"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Unexpected requests %v", paths)
+	}
+}
+
+func TestClient_Redirect(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Redirect(w, r, "/db/other", http.StatusMovedPermanently)
+	})
+	_, err := c.Get(context.Background(), "k")
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Status != http.StatusMovedPermanently {
+		t.Errorf("Expected a redirect error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single request, got %d", calls)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/db/missing":
+			writeError(w, http.StatusNotFound, "not_found")
+		case "/db/broken":
+			writeError(w, http.StatusInternalServerError, "checksum_mismatch")
+		default:
+			http.Error(w, "oops", http.StatusTeapot)
+		}
+	})
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := c.Get(ctx, "broken"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	_, err := c.Get(ctx, "other")
+	var serr *Error
+	if !errors.As(err, &serr) || serr.Status != http.StatusTeapot || serr.Message != "oops" {
+		t.Errorf("Unexpected error %#v", err)
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorrupted) {
+		t.Errorf("Error %v must not match the sentinels", err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			writeError(w, http.StatusServiceUnavailable, "unavailable")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"value": "v"})
+	})
+	if v, err := c.Get(context.Background(), "k"); err != nil || v != "v" {
+		t.Errorf("Unexpected Get result %q, %v", v, err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+
+	calls = 0
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeError(w, http.StatusBadGateway, "unavailable")
+	})
+	if _, err := c.Get(context.Background(), "k"); err == nil {
+		t.Error("Expected an error after the retries are exhausted")
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+
+	// client errors are not retried
+	calls = 0
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeError(w, http.StatusNotFound, "not_found")
+	})
+	c.Get(context.Background(), "k")
+	if calls != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls)
+	}
+}
+
+func TestClient_Unreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	c, err := New(server.URL, WithRetries(3, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the backoff to stop with the context, got %v", err)
+	}
+}
+
+func TestClient_MGet(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req mgetRequest
+		if r.Method != http.MethodPost || r.URL.Path != "/db/_mget" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bucket != "b" {
+			t.Errorf("Unexpected request body %+v, %v", req, err)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"values":  map[string]string{"a": "1"},
+			"missing": []string{"c"},
+		})
+	}, WithBucket("b"))
+	values, err := c.MGet(context.Background(), []string{"a", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]string{"a": "1"}) {
+		t.Errorf("Unexpected values %v", values)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, u := range []string{"", "db:8091", "ftp://db", "http://"} {
+		if _, err := New(u); err == nil {
+			t.Errorf("Expected an error for %q", u)
+		}
+	}
+	if _, err := New("http://db:8091/", WithRetries(-1, 0)); err == nil {
+		t.Error("Expected an error for negative retries")
+	}
+}
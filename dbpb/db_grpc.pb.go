@@ -0,0 +1,340 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: db.proto
+
+package dbpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DbClient is the client API for Db service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DbClient interface {
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	MGet(ctx context.Context, in *MGetRequest, opts ...grpc.CallOption) (*MGetResponse, error)
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Db_ScanClient, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Db_WatchClient, error)
+}
+
+type dbClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDbClient(cc grpc.ClientConnInterface) DbClient {
+	return &dbClient{cc}
+}
+
+func (c *dbClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, "/razur.db.v1.Db/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dbClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, "/razur.db.v1.Db/Put", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dbClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/razur.db.v1.Db/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dbClient) MGet(ctx context.Context, in *MGetRequest, opts ...grpc.CallOption) (*MGetResponse, error) {
+	out := new(MGetResponse)
+	err := c.cc.Invoke(ctx, "/razur.db.v1.Db/MGet", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dbClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Db_ScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Db_ServiceDesc.Streams[0], "/razur.db.v1.Db/Scan", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dbScanClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Db_ScanClient interface {
+	Recv() (*Record, error)
+	grpc.ClientStream
+}
+
+type dbScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *dbScanClient) Recv() (*Record, error) {
+	m := new(Record)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dbClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Db_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Db_ServiceDesc.Streams[1], "/razur.db.v1.Db/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dbWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Db_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type dbWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *dbWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DbServer is the server API for Db service.
+// All implementations must embed UnimplementedDbServer
+// for forward compatibility
+type DbServer interface {
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	MGet(context.Context, *MGetRequest) (*MGetResponse, error)
+	Scan(*ScanRequest, Db_ScanServer) error
+	Watch(*WatchRequest, Db_WatchServer) error
+	mustEmbedUnimplementedDbServer()
+}
+
+// UnimplementedDbServer must be embedded to have forward compatible implementations.
+type UnimplementedDbServer struct {
+}
+
+func (UnimplementedDbServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedDbServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedDbServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedDbServer) MGet(context.Context, *MGetRequest) (*MGetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MGet not implemented")
+}
+func (UnimplementedDbServer) Scan(*ScanRequest, Db_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedDbServer) Watch(*WatchRequest, Db_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedDbServer) mustEmbedUnimplementedDbServer() {}
+
+// UnsafeDbServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DbServer will
+// result in compilation errors.
+type UnsafeDbServer interface {
+	mustEmbedUnimplementedDbServer()
+}
+
+func RegisterDbServer(s grpc.ServiceRegistrar, srv DbServer) {
+	s.RegisterService(&Db_ServiceDesc, srv)
+}
+
+func _Db_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DbServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/razur.db.v1.Db/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DbServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Db_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DbServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/razur.db.v1.Db/Put",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DbServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Db_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DbServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/razur.db.v1.Db/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DbServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Db_MGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MGetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DbServer).MGet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/razur.db.v1.Db/MGet",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DbServer).MGet(ctx, req.(*MGetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Db_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DbServer).Scan(m, &dbScanServer{stream})
+}
+
+type Db_ScanServer interface {
+	Send(*Record) error
+	grpc.ServerStream
+}
+
+type dbScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *dbScanServer) Send(m *Record) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Db_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DbServer).Watch(m, &dbWatchServer{stream})
+}
+
+type Db_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type dbWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *dbWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Db_ServiceDesc is the grpc.ServiceDesc for Db service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Db_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "razur.db.v1.Db",
+	HandlerType: (*DbServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Db_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _Db_Put_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Db_Delete_Handler,
+		},
+		{
+			MethodName: "MGet",
+			Handler:    _Db_MGet_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Db_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Db_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "db.proto",
+}
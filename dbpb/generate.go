@@ -0,0 +1,4 @@
+// Package dbpb holds the gRPC API of cmd/db and its generated client.
+package dbpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative db.proto
@@ -2,4 +2,8 @@ module github.com/SofiaMazur/razur_s2_lab3
 
 go 1.16
 
-require github.com/stretchr/testify v1.7.0 // indirect
+require (
+	github.com/stretchr/testify v1.7.0
+	google.golang.org/grpc v1.47.0
+	google.golang.org/protobuf v1.28.1
+)
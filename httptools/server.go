@@ -1,14 +1,23 @@
 package httptools
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
 
+// timeout limits reading a request and writing its response.
+const timeout = 10 * time.Second
+
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits for the active
+	// requests to finish.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -19,18 +28,85 @@ func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
 		err := s.httpServer.ListenAndServe()
-		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		if err != http.ErrServerClosed {
+			log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		}
 	}()
 }
 
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+	return CreateServerAddr(fmt.Sprintf(":%d", port), handler)
+}
+
+// CreateServerAddr creates a server listening on the address in the
+// host:port form.
+func CreateServerAddr(addr string, handler http.Handler) Server {
+	return server{httpServer: newHTTPServer(addr, handler, timeout)}
+}
+
+func newHTTPServer(addr string, handler http.Handler, timeout time.Duration) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    timeout,
+		WriteTimeout:   timeout,
+		MaxHeaderBytes: 1 << 20,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, connDeadlines{c, timeout})
 		},
 	}
 }
+
+type connKey struct{}
+
+// connDeadlines moves the deadlines of the connection of a streaming
+// request.
+type connDeadlines struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d connDeadlines) extend() {
+	d.conn.SetDeadline(time.Now().Add(d.timeout))
+}
+
+// Streaming wraps a handler which reads or writes bodies of any size. The
+// server timeouts apply to every read and write of its bodies instead of
+// the whole request, so only stalled clients are cut off.
+func Streaming(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadlines, ok := r.Context().Value(connKey{}).(connDeadlines)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		r.Body = deadlineBody{r.Body, deadlines}
+		handler.ServeHTTP(deadlineWriter{w, deadlines}, r)
+	})
+}
+
+type deadlineBody struct {
+	io.ReadCloser
+	deadlines connDeadlines
+}
+
+func (b deadlineBody) Read(p []byte) (int, error) {
+	b.deadlines.extend()
+	return b.ReadCloser.Read(p)
+}
+
+// deadlineWriter extends the read deadline as well, the server watches
+// the connection for a close while the response is written.
+type deadlineWriter struct {
+	http.ResponseWriter
+	deadlines connDeadlines
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.deadlines.extend()
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,52 @@
+package httptools
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreaming(t *testing.T) {
+	const chunks = 6
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < chunks; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := w.Write([]byte("chunk\n")); err != nil {
+				return
+			}
+		}
+		if err := r.Context().Err(); err != nil && r.URL.Path == "/streaming" {
+			t.Errorf("Request context is done: %s", err)
+		}
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/plain", slow)
+	mux.Handle("/streaming", Streaming(slow))
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newHTTPServer("", mux, 200*time.Millisecond)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/streaming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != strings.Repeat("chunk\n", chunks) {
+		t.Errorf("Unexpected streaming response %q, %v", body, err)
+	}
+
+	// the response is flushed at the end, after the write deadline
+	resp, err = http.Get(server.URL + "/plain")
+	if err == nil {
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("Expected a timeout of the plain handler, got %q", body)
+	}
+}
@@ -0,0 +1,295 @@
+// Package metrics implements counters, gauges and histograms exposed in
+// the Prometheus text format. There is no global registry, every binary
+// creates its own.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets suit latencies measured in seconds.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics of a process.
+type Registry struct {
+	mtx     sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all the metrics in the order of their registration.
+func (r *Registry) WriteText(w io.Writer) {
+	r.mtx.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mtx.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	r.WriteText(rw)
+}
+
+// family holds the series of a metric by their label values.
+type family struct {
+	name, help, kind string
+	labels           []string
+	mtx              sync.Mutex
+	series           map[string]interface{}
+	values           map[string][]string
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+// get returns the series of the label values creating it with create.
+func (f *family) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	id := strings.Join(values, "\xff")
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	s, ok := f.series[id]
+	if !ok {
+		s = create()
+		f.series[id] = s
+		f.values[id] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// Delete removes the series of the label values, e.g. of a backend which
+// is gone.
+func (f *family) Delete(labelValues ...string) {
+	id := strings.Join(labelValues, "\xff")
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	delete(f.series, id)
+	delete(f.values, id)
+}
+
+// each calls fn for every series sorted by label values.
+func (f *family) each(fn func(labels string, s interface{})) {
+	f.mtx.Lock()
+	ids := make([]string, 0, len(f.series))
+	for id := range f.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	series := make([]interface{}, len(ids))
+	labels := make([]string, len(ids))
+	for i, id := range ids {
+		series[i] = f.series[id]
+		labels[i] = formatLabels(f.labels, f.values[id])
+	}
+	f.mtx.Unlock()
+	for i := range ids {
+		fn(labels[i], series[i])
+	}
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel appends a label to the formatted set of labels.
+func withLabel(labels, name, value string) string {
+	pair := fmt.Sprintf(`%s="%s"`, name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type value struct {
+	mtx sync.Mutex
+	v   float64
+}
+
+func (v *value) add(delta float64) {
+	v.mtx.Lock()
+	v.v += delta
+	v.mtx.Unlock()
+}
+
+func (v *value) set(x float64) {
+	v.mtx.Lock()
+	v.v = x
+	v.mtx.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.v
+}
+
+// Counter is a value which only grows.
+type Counter struct {
+	*family
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("counter can't decrease")
+	}
+	c.get(labelValues, func() interface{} { return new(value) }).(*value).add(delta)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	c.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(s.(*value).get()))
+	})
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	*family
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newFamily(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.get(labelValues, func() interface{} { return new(value) }).(*value).set(v)
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.get(labelValues, func() interface{} { return new(value) }).(*value).add(delta)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.writeHeader(w)
+	g.each(func(labels string, s interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(s.(*value).get()))
+	})
+}
+
+type histogramValue struct {
+	mtx    sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations in buckets of upper bounds.
+type Histogram struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogram creates a histogram with the sorted upper bounds of buckets,
+// the +Inf bucket is added automatically.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: append([]float64(nil), buckets...),
+	}
+	sort.Float64s(h.buckets)
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	hv := h.get(labelValues, func() interface{} {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	}).(*histogramValue)
+	hv.mtx.Lock()
+	defer hv.mtx.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.each(func(labels string, s interface{}) {
+		hv := s.(*histogramValue)
+		hv.mtx.Lock()
+		defer hv.mtx.Unlock()
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(labels, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(labels, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, hv.count)
+	})
+}
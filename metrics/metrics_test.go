@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Handled requests.", "code")
+	inFlight := r.NewGauge("in_flight", "Requests in flight.")
+	latency := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.5, 0.1}, "path")
+
+	requests.Inc("500")
+	requests.Add(2, "200")
+	inFlight.Set(3)
+	inFlight.Add(-1)
+	latency.Observe(0.05, `a"b`)
+	latency.Observe(0.3, `a"b`)
+	latency.Observe(7, `a"b`)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP requests_total Handled requests.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="500"} 1
+# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight 2
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="a\"b",le="0.1"} 1
+latency_seconds_bucket{path="a\"b",le="0.5"} 2
+latency_seconds_bucket{path="a\"b",le="+Inf"} 3
+latency_seconds_sum{path="a\"b"} 7.35
+latency_seconds_count{path="a\"b"} 3
+`
+	if got := rec.Body.String(); got != expected {
+		t.Errorf("Unexpected output:\n%s", got)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+}
+
+func TestCounter_LabelsMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic")
+		}
+	}()
+	NewRegistry().NewCounter("c", "help", "label").Inc()
+}
+
+func TestGauge_Delete(t *testing.T) {
+	r := NewRegistry()
+	up := r.NewGauge("up", "Whether the backend is up.", "backend")
+	up.Set(1, "a")
+	up.Set(0, "b")
+	up.Delete("b")
+	up.Delete("missing")
+
+	var b strings.Builder
+	r.WriteText(&b)
+	expected := `# HELP up Whether the backend is up.
+# TYPE up gauge
+up{backend="a"} 1
+`
+	if got := b.String(); got != expected {
+		t.Errorf("Unexpected output:\n%s", got)
+	}
+}
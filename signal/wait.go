@@ -8,8 +8,16 @@ import (
 )
 
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
 	log.Println("Shutting down...")
 }
+
+// NotifyReload returns the channel receiving SIGHUP, which asks the
+// process to reload its configuration.
+func NotifyReload() <-chan os.Signal {
+	reloadChannel := make(chan os.Signal, 1)
+	signal.Notify(reloadChannel, syscall.SIGHUP)
+	return reloadChannel
+}